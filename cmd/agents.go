@@ -16,7 +16,7 @@ package cmd
 
 import (
 	"fmt"
-	"math/rand"
+	"sync"
 
 	"github.com/spf13/cobra"
 
@@ -36,10 +36,22 @@ var agentsCmd = &cobra.Command{
 		// since we have so many small little outputs they would each be sending the same data which would be a bit crazy.
 		initStats(false, "agents")
 
+		recorded.addTargetRate(float64(agents*metricsPerAgent) / float64(period))
+		lim := newRunLimit(runDuration, maxPoints)
+		lim.stopOnSignal()
+		rng := newRand()
+		wg := &sync.WaitGroup{}
+		wg.Add(agents)
 		for i := 0; i < agents; i++ {
-			go agent(i)
+			// each agent starts at an arbitrary time between 0 and period
+			sleep := time.Duration(rng.Int63n(int64(period) * int64(time.Second)))
+			go func(i int) {
+				agent(i, sleep, lim)
+				wg.Done()
+			}(i)
 		}
-		select {}
+		wg.Wait()
+		finishRun(lim)
 	},
 }
 
@@ -53,13 +65,19 @@ func init() {
 	agentsCmd.Flags().IntVar(&agents, "agents", 1000, "how many agents to simulate")
 	agentsCmd.Flags().IntVar(&metricsPerAgent, "metrics", 10, "how many metrics per agent to simulate")
 	agentsCmd.Flags().DurationVar(&periodDur, "period", 10*time.Second, "period between metric points (must be a multiple of 1s)")
+	agentsCmd.Flags().DurationVar(&runDuration, "duration", 0, "how long to run for. 0 to run until interrupted")
+	agentsCmd.Flags().Int64Var(&maxPoints, "max-points", 0, "stop after sending this many points, across all agents. 0 for no limit")
 }
 
-func agent(id int) {
-	// first sleep an arbitrary time between 0 and period
-	sleep := time.Duration(rand.Intn(int(period)))
-	time.Sleep(sleep)
+// agent runs until the limit ends the run, then closes its outputs
+func agent(id int, sleep time.Duration, lim *runLimit) {
+	select {
+	case <-time.After(sleep):
+	case <-lim.Done():
+		return
+	}
 	outs := getOutputs()
+	defer closeOutputs(outs)
 
 	met := make([]*schema.MetricData, metricsPerAgent)
 	for i := 0; i < metricsPerAgent; i++ {
@@ -80,8 +98,13 @@ func agent(id int) {
 			met[i].Time = t.Unix()
 			met[i].Value = float64(id*metricsPerAgent + i)
 		}
+		n := lim.take(metricsPerAgent)
+		if n == 0 {
+			return
+		}
+		pointsGenerated.Inc(int64(n))
 		for _, out := range outs {
-			err := out.Flush(met)
+			err := out.Flush(met[:n])
 			if err != nil {
 				log.Error(0, err.Error())
 			}
@@ -90,7 +113,13 @@ func agent(id int) {
 
 	do(time.Now())
 	tick := time.NewTicker(time.Duration(period) * time.Second)
-	for t := range tick.C {
-		do(t)
+	defer tick.Stop()
+	for {
+		select {
+		case <-lim.Done():
+			return
+		case t := <-tick.C:
+			do(t)
+		}
 	}
 }
@@ -57,9 +57,10 @@ func agginput() {
 	fmt.Println("building data..")
 	pre := time.Now()
 
+	rng := newRand()
 	var aggInputs []string
 	for i := 0; i < 200; i++ {
-		aggInputs = append(aggInputs, RandString(8))
+		aggInputs = append(aggInputs, RandString(rng, 8))
 	}
 
 	// note that the random parts also have a predictable part to them, so that we can have a static dashboard config pointing to a single series even when it's random
@@ -67,7 +68,7 @@ func agginput() {
 
 	// 100 total, 200 inputs to each
 	for i := 1; i <= 100; i++ {
-		a := fmt.Sprintf("%s-%d", RandString(4), i)
+		a := fmt.Sprintf("%s-%d", RandString(rng, 4), i)
 		for _, input := range aggInputs {
 			metrics = append(metrics, "core.bidder.pops.nyc."+input+"."+a)
 		}
@@ -75,7 +76,7 @@ func agginput() {
 
 	// 10 total, 200 inputs to each
 	for i := 1; i <= 10; i++ {
-		a := fmt.Sprintf("%s-%d", RandString(4), i)
+		a := fmt.Sprintf("%s-%d", RandString(rng, 4), i)
 		for _, input := range aggInputs {
 			metrics = append(metrics, "core.bidder.pops.nyc."+input+".A."+a)
 			metrics = append(metrics, "core.bidder.pops.nyc."+input+".B."+a)
@@ -85,7 +86,7 @@ func agginput() {
 	// 3k total, 200 inputs to each
 	for i := 1; i <= 3500; i++ {
 		a := fmt.Sprintf("%.4d", i)
-		b := fmt.Sprintf("%s-%d", RandString(8), i)
+		b := fmt.Sprintf("%s-%d", RandString(rng, 8), i)
 		for _, input := range aggInputs {
 			metrics = append(metrics, "core.bidder.pops.nyc."+input+".C."+a+"."+b)
 		}
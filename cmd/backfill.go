@@ -17,6 +17,7 @@ package cmd
 import (
 	"time"
 
+	"github.com/raintank/worldping-api/pkg/log"
 	"github.com/spf13/cobra"
 )
 
@@ -27,18 +28,40 @@ var backfillCmd = &cobra.Command{
 		initStats(true, "backfill")
 		period = int(periodDur.Seconds())
 		flush = int(flushDur.Nanoseconds() / 1000 / 1000)
+		vg, err := NewValueGenerator(valueModel, newRand())
+		if err != nil {
+			log.Fatal(4, "%s", err)
+		}
+		tb, err := newTaggedBuilder()
+		if err != nil {
+			log.Fatal(4, "%s", err)
+		}
+		lim := newRunLimit(runDuration, maxPoints)
+		lim.stopOnSignal()
 		outs := getOutputs()
-		dataFeed(outs, orgs, mpo, period, flush, int(offset.Seconds()), speedup, true, TaggedBuilder{metricName})
+		err = dataFeed("backfill", outs, orgs, mpo, period, flush, tb, vg, feedOptions{offset: int(offset.Seconds()), speedup: speedup, stopAtNow: true, maxLag: maxLag}, lim)
+		if err != nil {
+			lim.stop(err.Error())
+		}
+		closeOutputs(outs)
+		finishRun(lim)
+		if err != nil {
+			log.Fatal(4, "%s", err)
+		}
 	},
 }
 
 func init() {
 	rootCmd.AddCommand(backfillCmd)
 	backfillCmd.Flags().StringVar(&metricName, "metricname", "some.id.of.a.metric", "the metric name to use")
+	backfillCmd.Flags().StringVar(&valueModel, "value-model", "random", valueModelHelp)
 	backfillCmd.Flags().DurationVar(&offset, "offset", 0, "offset duration expression. (how far back in time to start. e.g. 1month, 6h, etc). must be a multiple of 1s")
 	backfillCmd.Flags().IntVar(&orgs, "orgs", 1, "how many orgs to simulate")
 	backfillCmd.Flags().IntVar(&mpo, "mpo", 100, "how many metrics per org to simulate")
 	backfillCmd.Flags().IntVar(&speedup, "speedup", 1, "for each advancement of real time, how many advancements of fake data to simulate")
 	backfillCmd.Flags().DurationVar(&flushDur, "flush", time.Second, "how often to flush metrics")
 	backfillCmd.Flags().DurationVar(&periodDur, "period", time.Second, "period between metric points (must be a multiple of 1s)")
+	backfillCmd.Flags().DurationVar(&runDuration, "duration", 0, "how long to run for. 0 to run until 'now' is reached or interrupted")
+	backfillCmd.Flags().Int64Var(&maxPoints, "max-points", 0, "stop after sending this many points. 0 for no limit")
+	backfillCmd.Flags().DurationVar(&maxLag, "max-lag", 0, "fail when falling further behind schedule than this, because flushing can't keep up. 0 to never fail")
 }
@@ -15,10 +15,10 @@
 package cmd
 
 import (
+	"fmt"
+	"strings"
 	"time"
 
-	"github.com/grafana/metrictank/schema"
-	"github.com/raintank/fakemetrics/out"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 )
@@ -32,19 +32,59 @@ var flags struct {
 	invalidTags      bool
 	outOfOrder       uint
 	duplicate        bool
+	farFuture        bool
+	tooOld           bool
+	longName         bool
+	longTagValue     bool
+	unicodeName      bool
+	hugeTagCount     bool
+	idMismatch       bool
+	conflicting      bool
+	malformedMsgp    bool
+	pct              float64
 }
 
 var badCmd = &cobra.Command{
 	Use:   "bad",
-	Short: "Sends out invalid/out-of-order/duplicate metric data",
+	Short: "Sends out a feed with invalid/out-of-order/duplicate metric data mixed in",
+	Long: `Sends out a feed like the feed command, and replaces a percentage of its points with invalid data
+of each of the selected kinds. a point gets at most one kind of invalid data, and the report counts the points of each kind,
+so that you can verify that ingestion rejects exactly those points without affecting the other points of the same or other series.`,
 	Run: func(cmd *cobra.Command, args []string) {
 		initStats(true, "bad")
+		period = int(periodDur.Seconds())
+		flush = int(flushDur.Nanoseconds() / 1000 / 1000)
+		vg, err := NewValueGenerator(valueModel, newRand())
+		if err != nil {
+			log.Fatal(err)
+		}
+		tb, err := newTaggedBuilder()
+		if err != nil {
+			log.Fatal(err)
+		}
+		spec, err := badFaultSpec()
+		if err != nil {
+			log.Fatal(err)
+		}
+		faults, err := newFaultInjector(spec, newRand())
+		if err != nil {
+			log.Fatal(err)
+		}
+		lim := newRunLimit(runDuration, maxPoints)
+		lim.stopOnSignal()
 		outs := getOutputs()
 		if len(outs) == 0 {
 			log.Fatal("need to define an output")
 		}
-
-		generateData(outs)
+		err = dataFeed("bad", outs, orgs, mpo, period, flush, tb, vg, feedOptions{faults: faults}, lim)
+		if err != nil {
+			lim.stop(err.Error())
+		}
+		closeOutputs(outs)
+		finishRun(lim)
+		if err != nil {
+			log.Fatal(err)
+		}
 	},
 }
 
@@ -56,66 +96,68 @@ func init() {
 	badCmd.Flags().BoolVar(&flags.invalidName, "invalid-name", false, "use an invalid name")
 	badCmd.Flags().BoolVar(&flags.invalidMtype, "invalid-mtype", false, "use an invalid mtype")
 	badCmd.Flags().BoolVar(&flags.invalidTags, "invalid-tags", false, "use an invalid tag")
-	badCmd.Flags().UintVar(&flags.outOfOrder, "out-of-order", 0, "send data periodically in an inverted order (optionally specify number of inverted data points per period)")
+	badCmd.Flags().UintVar(&flags.outOfOrder, "out-of-order", 0, "send data out of order: points with a timestamp this many points before the last one sent")
 	badCmd.Flag("out-of-order").NoOptDefVal = "5"
-	badCmd.Flags().BoolVar(&flags.duplicate, "duplicate", false, "send duplicate data")
+	badCmd.Flags().BoolVar(&flags.duplicate, "duplicate", false, "send duplicate data: points with the timestamp of the last one sent")
+	badCmd.Flags().BoolVar(&flags.farFuture, "far-future", false, "use a timestamp far in the future")
+	badCmd.Flags().BoolVar(&flags.tooOld, "too-old", false, "use a timestamp older than the retention")
+	badCmd.Flags().BoolVar(&flags.longName, "long-name", false, "use an extremely long name")
+	badCmd.Flags().BoolVar(&flags.longTagValue, "long-tag-value", false, "add a tag with an extremely long value")
+	badCmd.Flags().BoolVar(&flags.unicodeName, "unicode-name", false, "use unicode and control characters in the name")
+	badCmd.Flags().BoolVar(&flags.hugeTagCount, "huge-tag-count", false, "add a huge amount of tags")
+	badCmd.Flags().BoolVar(&flags.idMismatch, "id-mismatch", false, "use an id that is not derived from the name")
+	badCmd.Flags().BoolVar(&flags.conflicting, "conflicting-interval", false, "use another interval for the same name and tags")
+	badCmd.Flags().BoolVar(&flags.malformedMsgp, "malformed-msgp", false, "send a malformed msgp payload (requires a kafka output)")
+	badCmd.Flags().Float64Var(&flags.pct, "pct", 10, "percentage of the points to replace by each of the selected kinds of invalid data")
+	badCmd.Flags().StringVar(&faultSpec, "faults", "", "faults to inject in addition to the selected invalid data, and the params of the invalid data, such as 'far-future-by=48h,tag-count=10000'. see feed --help")
+	badCmd.Flags().StringVar(&metricName, "metricname", "some.id.of.a.metric", "the metric name to use")
+	badCmd.Flags().StringVar(&valueModel, "value-model", "random", valueModelHelp)
+	badCmd.Flags().IntVar(&orgs, "orgs", 1, "how many orgs to simulate")
+	badCmd.Flags().IntVar(&mpo, "mpo", 100, "how many metrics per org to simulate")
+	badCmd.Flags().DurationVar(&flushDur, "flush", time.Second, "how often to flush metrics")
+	badCmd.Flags().DurationVar(&periodDur, "period", time.Second, "period between metric points (must be a multiple of 1s)")
+	badCmd.Flags().DurationVar(&runDuration, "duration", 0, "how long to run for. 0 to run until interrupted")
+	badCmd.Flags().Int64Var(&maxPoints, "max-points", 0, "stop after sending this many points. 0 for no limit")
 }
 
-func generateData(outs []out.Out) {
-	md := &schema.MetricData{
-		Name:     "some.id.of.a.metric.0",
-		OrgId:    1,
-		Interval: 1,
-		Unit:     "s",
-		Mtype:    "gauge",
-		Tags:     nil,
-	}
-
-	if flags.invalidInterval {
-		md.Interval = 0 // 0 or >= math.MaxInt32
-	}
-
-	if flags.invalidOrgID {
-		md.OrgId = 0
-	}
-
-	if flags.invalidName {
-		md.Name = ""
-	}
-
-	if flags.invalidMtype {
-		md.Mtype = "invalid Mtype"
+// badFaultSpec returns the faults spec for the selected kinds of invalid data
+func badFaultSpec() (string, error) {
+	if flags.pct <= 0 || flags.pct > 100 {
+		return "", fmt.Errorf("pct must be > 0 and <= 100")
 	}
-
-	if flags.invalidTags {
-		md.Tags = []string{"==invalid tags,#4561=="}
+	prob := flags.pct / 100
+	var parts []string
+	if faultSpec != "" {
+		parts = append(parts, faultSpec)
 	}
-
-	md.SetId()
-	sl := []*schema.MetricData{md}
-
-	tick := time.NewTicker(time.Second)
-	for ts := range tick.C {
-		timestamp := ts.Unix()
-		if flags.invalidTimestamp {
-			timestamp = 0 // 0 or >= math.MaxInt32
-		} else if flags.outOfOrder > 0 {
-			n := int64(flags.outOfOrder)
-			// invert in time n data points with the following n data points
-			if timestamp%(2*n) < n {
-				timestamp -= n
-			} else {
-				timestamp += n
-			}
-		} else if flags.duplicate {
-			if md.Time != 0 {
-				timestamp = md.Time
-			}
-		}
-		md.Time = timestamp
-		md.Value = float64(2.0)
-		for _, o := range outs {
-			o.Flush(sl)
+	for _, k := range []struct {
+		key      string
+		selected bool
+	}{
+		{"invalid-timestamp", flags.invalidTimestamp},
+		{"invalid-interval", flags.invalidInterval},
+		{"invalid-orgid", flags.invalidOrgID},
+		{"invalid-name", flags.invalidName},
+		{"invalid-mtype", flags.invalidMtype},
+		{"invalid-tags", flags.invalidTags},
+		{"out-of-order", flags.outOfOrder > 0},
+		{"duplicate", flags.duplicate},
+		{"far-future", flags.farFuture},
+		{"too-old", flags.tooOld},
+		{"long-name", flags.longName},
+		{"long-tag-value", flags.longTagValue},
+		{"unicode-name", flags.unicodeName},
+		{"huge-tag-count", flags.hugeTagCount},
+		{"id-mismatch", flags.idMismatch},
+		{"conflicting-interval", flags.conflicting},
+		{malformedMsgp, flags.malformedMsgp},
+	} {
+		if k.selected {
+			parts = append(parts, fmt.Sprintf("%s=%g", k.key, prob))
 		}
 	}
+	if flags.outOfOrder > 0 {
+		parts = append(parts, fmt.Sprintf("out-of-order-by=%d", flags.outOfOrder))
+	}
+	return strings.Join(parts, ","), nil
 }
@@ -0,0 +1,235 @@
+package cmd
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+)
+
+const tagCardinalityHelp = "tags to add, with the amount of distinct values of each: comma separated key:values pairs, e.g. 'region:5,host:1000,endpoint:zipf(200)'. " +
+	"with zipf(n) or zipf(n,s) the series are spread over the values according to a zipf distribution with exponent s > 1 (default 1.1), rather than uniformly. " +
+	"when mpo is the product of all amounts, the series are the full cross-product; when it's less, a sample of it. " +
+	"each tag has exactly the given amount of values, as long as mpo is at least that much. beyond the cross-product, the tag sets repeat, with a number appended to the name. " +
+	"conflicts with add-tags and custom-tags"
+
+// defaultZipfExponent is the exponent used for zipf(n)
+const defaultZipfExponent = 1.1
+
+// tagCardinality describes the values of a tag
+type tagCardinality struct {
+	key    string
+	values int
+	zipf   float64 // exponent of the zipf distribution of the values over the series. 0 for uniform
+}
+
+func (t tagCardinality) String() string {
+	if t.zipf > 0 {
+		return fmt.Sprintf("%s:zipf(%d,%g)", t.key, t.values, t.zipf)
+	}
+	return fmt.Sprintf("%s:%d", t.key, t.values)
+}
+
+// tag returns the tag for the given value index
+func (t tagCardinality) tag(v int) string {
+	return fmt.Sprintf("%s=%s-%d", t.key, t.key, v)
+}
+
+// splitTopLevel splits s on commas that are not within parentheses
+func splitTopLevel(s string) []string {
+	var parts []string
+	depth, begin := 0, 0
+	for i, c := range s {
+		switch c {
+		case '(':
+			depth++
+		case ')':
+			depth--
+		case ',':
+			if depth == 0 {
+				parts = append(parts, s[begin:i])
+				begin = i + 1
+			}
+		}
+	}
+	return append(parts, s[begin:])
+}
+
+// parseTagCardinality parses a spec such as 'region:5,host:1000,endpoint:zipf(200)'
+func parseTagCardinality(spec string) ([]tagCardinality, error) {
+	if spec == "" {
+		return nil, nil
+	}
+	var card []tagCardinality
+	seen := make(map[string]bool)
+	for _, part := range splitTopLevel(spec) {
+		kv := strings.SplitN(strings.TrimSpace(part), ":", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, fmt.Errorf("tag cardinality %q must be of the form key:values", part)
+		}
+		t := tagCardinality{key: kv[0]}
+		if seen[t.key] {
+			return nil, fmt.Errorf("tag cardinality: duplicate tag %q", t.key)
+		}
+		seen[t.key] = true
+
+		values := kv[1]
+		if strings.HasPrefix(values, "zipf(") && strings.HasSuffix(values, ")") {
+			args := strings.Split(values[len("zipf("):len(values)-1], ",")
+			if len(args) > 2 {
+				return nil, fmt.Errorf("tag cardinality %q: zipf takes at most 2 arguments", part)
+			}
+			values = strings.TrimSpace(args[0])
+			t.zipf = defaultZipfExponent
+			if len(args) == 2 {
+				s, err := strconv.ParseFloat(strings.TrimSpace(args[1]), 64)
+				if err != nil || s <= 1 {
+					return nil, fmt.Errorf("tag cardinality %q: zipf exponent must be a number > 1", part)
+				}
+				t.zipf = s
+			}
+		}
+		n, err := strconv.Atoi(values)
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("tag cardinality %q: amount of values must be a number >= 1", part)
+		}
+		t.values = n
+		card = append(card, t)
+	}
+	if crossProduct(card) == 0 {
+		return nil, fmt.Errorf("tag cardinality %q: too many unique tag sets", spec)
+	}
+	return card, nil
+}
+
+// maxCrossProduct is the max amount of unique tag sets we support, such that they can be indexed by an int64
+const maxCrossProduct = 1 << 62
+
+// crossProduct returns the amount of unique tag sets, or 0 if it exceeds maxCrossProduct
+func crossProduct(card []tagCardinality) int {
+	p := 1
+	for _, t := range card {
+		if p > maxCrossProduct/t.values {
+			return 0
+		}
+		p *= t.values
+	}
+	return p
+}
+
+// tagSetSampler draws unique tag sets, encoded as their index in the cross-product
+type tagSetSampler struct {
+	card []tagCardinality
+	rng  *rand.Rand
+	zipf []*rand.Zipf // per tag. nil for uniform tags
+	used map[int]bool
+	p    int
+}
+
+func (s *tagSetSampler) encode(vals []int) int {
+	idx := 0
+	for i := len(s.card) - 1; i >= 0; i-- {
+		idx = idx*s.card[i].values + vals[i]
+	}
+	return idx
+}
+
+func (s *tagSetSampler) decode(idx int) []int {
+	vals := make([]int, len(s.card))
+	for i, t := range s.card {
+		vals[i] = idx % t.values
+		idx /= t.values
+	}
+	return vals
+}
+
+// add adds the given tag set if it wasn't used yet, or otherwise the next unused one
+func (s *tagSetSampler) add(idx int) []int {
+	for s.used[idx] {
+		idx = (idx + 1) % s.p
+	}
+	s.used[idx] = true
+	return s.decode(idx)
+}
+
+// drawValue draws a random value of tag i
+func (s *tagSetSampler) drawValue(i int) int {
+	if s.zipf[i] != nil {
+		return int(s.zipf[i].Uint64())
+	}
+	return s.rng.Intn(s.card[i].values)
+}
+
+// sampleTagSets returns n unique tag sets (n must not exceed the cross-product), as the value index of each tag.
+// the first tag sets give each tag all of its values once (as far as n allows), in random order,
+// so that the amount of values of each tag is exact. the tags that have had all their values by then,
+// as well as all tags of the remaining tag sets, get values drawn following their distribution.
+func sampleTagSets(card []tagCardinality, n int, rng *rand.Rand) [][]int {
+	s := &tagSetSampler{
+		card: card,
+		rng:  rng,
+		zipf: make([]*rand.Zipf, len(card)),
+		used: make(map[int]bool, n),
+		p:    crossProduct(card),
+	}
+	sets := make([][]int, 0, n)
+	if n == s.p {
+		for idx := 0; idx < n; idx++ {
+			sets = append(sets, s.decode(idx))
+		}
+		return sets
+	}
+
+	// the tag with the most values makes the first tag sets unique
+	perms := make([][]int, len(card))
+	covered := 0
+	for i, t := range card {
+		if t.values < n {
+			perms[i] = rng.Perm(t.values)
+		} else {
+			perms[i] = rng.Perm(n)
+		}
+		if len(perms[i]) > covered {
+			covered = len(perms[i])
+		}
+		if t.zipf > 0 {
+			s.zipf[i] = rand.NewZipf(rng, t.zipf, 1, uint64(t.values-1))
+		}
+	}
+	for j := 0; j < covered; j++ {
+		vals := make([]int, len(card))
+		for i := range card {
+			if j < len(perms[i]) {
+				vals[i] = perms[i][j]
+			} else {
+				vals[i] = s.drawValue(i)
+			}
+		}
+		sets = append(sets, s.add(s.encode(vals)))
+	}
+	if len(sets) == n {
+		return sets
+	}
+
+	// when we need most of the cross-product, drawing at random would mostly hit tag sets that are taken,
+	// so we pick from the remaining ones in random order instead
+	if 2*n > s.p {
+		for _, idx := range rng.Perm(s.p) {
+			if len(sets) == n {
+				break
+			}
+			if !s.used[idx] {
+				sets = append(sets, s.add(idx))
+			}
+		}
+		return sets
+	}
+	vals := make([]int, len(card))
+	for len(sets) < n {
+		for i := range card {
+			vals[i] = s.drawValue(i)
+		}
+		sets = append(sets, s.add(s.encode(vals)))
+	}
+	return sets
+}
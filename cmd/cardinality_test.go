@@ -0,0 +1,114 @@
+package cmd
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+func TestParseTagCardinality(t *testing.T) {
+	cases := []struct {
+		spec   string
+		exp    string
+		expErr bool
+	}{
+		{"region:5,host:1000", "[region:5 host:1000]", false},
+		{"region:5, endpoint:zipf(200)", "[region:5 endpoint:zipf(200,1.1)]", false},
+		{"endpoint:zipf(200,2),pod:50000", "[endpoint:zipf(200,2) pod:50000]", false},
+		{"region", "", true},
+		{"region:0", "", true},
+		{"region:5,region:6", "", true},
+		{"endpoint:zipf(200,1)", "", true},
+		{"endpoint:zipf(200,2,3)", "", true},
+		{"a:100000,b:100000,c:100000,d:100000,e:100000", "", true},
+	}
+	for _, c := range cases {
+		card, err := parseTagCardinality(c.spec)
+		if c.expErr {
+			if err == nil {
+				t.Errorf("spec %q: expected error, got none", c.spec)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("spec %q: expected no error, got %s", c.spec, err)
+			continue
+		}
+		if got := fmt.Sprint(card); got != c.exp {
+			t.Errorf("spec %q: expected %s, got %s", c.spec, c.exp, got)
+		}
+	}
+}
+
+func TestSampleTagSets(t *testing.T) {
+	cases := []struct {
+		spec      string
+		n         int
+		expValues []int
+	}{
+		{"region:5,host:20", 100, []int{5, 20}},
+		{"region:5,host:20", 40, []int{5, 20}},
+		{"region:5,host:20", 90, []int{5, 20}},
+		{"region:5,host:20", 3, []int{3, 3}},
+		{"region:3,endpoint:zipf(50)", 80, []int{3, 50}},
+	}
+	for _, c := range cases {
+		card, err := parseTagCardinality(c.spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sets := sampleTagSets(card, c.n, rand.New(rand.NewSource(1)))
+		if len(sets) != c.n {
+			t.Fatalf("spec %q, n %d: expected %d tag sets, got %d", c.spec, c.n, c.n, len(sets))
+		}
+		seen := make(map[string]bool)
+		values := make([]map[int]bool, len(card))
+		for i := range values {
+			values[i] = make(map[int]bool)
+		}
+		for _, set := range sets {
+			key := fmt.Sprint(set)
+			if seen[key] {
+				t.Fatalf("spec %q, n %d: duplicate tag set %s", c.spec, c.n, key)
+			}
+			seen[key] = true
+			for i, v := range set {
+				values[i][v] = true
+			}
+		}
+		for i, exp := range c.expValues {
+			if len(values[i]) != exp {
+				t.Errorf("spec %q, n %d: expected tag %s to have %d values, got %d", c.spec, c.n, card[i].key, exp, len(values[i]))
+			}
+		}
+	}
+}
+
+func TestBuildTagCardinality(t *testing.T) {
+	card, err := parseTagCardinality("region:2,host:3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tb := TaggedBuilder{metricName: "a", tagCardinality: card, seed: 1}
+	metrics := tb.Build(2, 12, 1)
+	if len(metrics) != 2 || len(metrics[1]) != 12 {
+		t.Fatalf("expected 2 orgs of 12 series")
+	}
+	seen := make(map[string]bool)
+	for _, md := range metrics[1] {
+		key := fmt.Sprint(md.Name, md.Tags)
+		if seen[key] {
+			t.Fatalf("duplicate series %s", key)
+		}
+		seen[key] = true
+	}
+	if metrics[1][0].Name != "a.1" || metrics[1][11].Name != "a.2" {
+		t.Fatalf("expected the name to tell repeated tag sets apart, got %q and %q", metrics[1][0].Name, metrics[1][11].Name)
+	}
+	again := tb.Build(2, 12, 1)
+	for m := range metrics[0] {
+		if fmt.Sprint(metrics[0][m].Tags) != fmt.Sprint(again[0][m].Tags) {
+			t.Fatalf("series %d: expected the same tags for every build, got %v and %v", m, metrics[0][m].Tags, again[0][m].Tags)
+		}
+	}
+}
@@ -0,0 +1,123 @@
+// Copyright © 2018 Grafana Labs
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/grafana/metrictank/schema"
+)
+
+// churner simulates series churn, like pods being rescheduled:
+// every interval (of data time), a percentage of the series of each org is retired
+// and replaced by a new series with a unique name. retired series stop sending,
+// so they go stale and can be pruned by the backend.
+// the series are replaced round robin, so that eventually all of them get replaced.
+// a nil *churner doesn't churn.
+type churner struct {
+	pct      float64 // percentage of series per org to replace each interval
+	interval int64   // in s
+	round    int     // amount of times we churned
+	rounds   []int   // for each series index, in which round it was last replaced. 0 if never
+	next     int     // index of the next series to replace
+	acc      float64 // carried over fraction of a series to replace
+	since    int64   // ts of the last churn
+
+	base    [][]schema.MetricData // the series as built
+	metrics [][]schema.MetricData // the series as currently active
+}
+
+// newChurner returns a churner, or nil if interval is 0
+func newChurner(pct float64, interval time.Duration) (*churner, error) {
+	if interval == 0 {
+		return nil, nil
+	}
+	if interval < time.Second || interval%time.Second != 0 {
+		return nil, fmt.Errorf("churn interval must be a multiple of 1s, you entered %s", interval)
+	}
+	if pct <= 0 || pct > 100 {
+		return nil, fmt.Errorf("churn pct must be > 0 and <= 100, you entered %g", pct)
+	}
+	return &churner{
+		pct:      pct,
+		interval: int64(interval.Seconds()),
+	}, nil
+}
+
+// init sets the series as built, starting at the given ts, and returns them with the churn applied so far.
+// it is called again when the amount of series per org changes.
+func (c *churner) init(base [][]schema.MetricData, ts int64) [][]schema.MetricData {
+	if c == nil {
+		return base
+	}
+	if c.base == nil {
+		c.since = ts
+	}
+	c.base = base
+	c.metrics = make([][]schema.MetricData, len(base))
+	for o := range base {
+		c.metrics[o] = make([]schema.MetricData, len(base[o]))
+	}
+	if len(base) > 0 {
+		for len(c.rounds) < len(base[0]) {
+			c.rounds = append(c.rounds, 0)
+		}
+		if c.next >= len(base[0]) {
+			c.next = 0
+		}
+		for m := range base[0] {
+			c.replace(m)
+		}
+	}
+	return c.metrics
+}
+
+// replace sets series m of every org to its identity for the round it was last replaced in
+func (c *churner) replace(m int) {
+	round := c.rounds[m]
+	for o := range c.metrics {
+		md := c.base[o][m]
+		if round > 0 {
+			md.Name = fmt.Sprintf("%s.churn%d", md.Name, round)
+			md.SetId()
+		}
+		c.metrics[o][m] = md
+	}
+}
+
+// churn replaces the series that are due to be replaced as of the given ts.
+// it returns how many series got replaced, over all orgs.
+func (c *churner) churn(ts int64) int {
+	if c == nil || len(c.metrics) == 0 {
+		return 0
+	}
+	mpo := len(c.metrics[0])
+	var replaced int
+	for ts >= c.since+c.interval {
+		c.since += c.interval
+		c.round++
+		c.acc += float64(mpo) * c.pct / 100
+		num := int(c.acc)
+		c.acc -= float64(num)
+		for i := 0; i < num; i++ {
+			c.rounds[c.next] = c.round
+			c.replace(c.next)
+			c.next = (c.next + 1) % mpo
+		}
+		replaced += num * len(c.metrics)
+	}
+	return replaced
+}
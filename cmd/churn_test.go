@@ -0,0 +1,61 @@
+package cmd
+
+import (
+	"testing"
+	"time"
+)
+
+func TestChurner(t *testing.T) {
+	c, err := newChurner(25, 10*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	metrics := c.init(SimpleBuilder{"a"}.Build(2, 6, 1), 1000)
+
+	if n := c.churn(1009); n != 0 {
+		t.Fatalf("expected no churn before the interval passed, got %d", n)
+	}
+	// 1.5 series per org per interval: 1 in the first round, 2 in the second
+	if n := c.churn(1010); n != 2 {
+		t.Fatalf("expected 2 series replaced, got %d", n)
+	}
+	if n := c.churn(1025); n != 4 {
+		t.Fatalf("expected 4 series replaced, got %d", n)
+	}
+	exp := []string{"a.1.churn1", "a.2.churn2", "a.3.churn2", "a.4", "a.5", "a.6"}
+	for o := range metrics {
+		for m, md := range metrics[o] {
+			if md.Name != exp[m] {
+				t.Fatalf("org %d series %d: expected name %q, got %q", o, m, exp[m], md.Name)
+			}
+		}
+	}
+
+	// when the amount of series changes, the replaced ones keep their new identity
+	metrics = c.init(SimpleBuilder{"a"}.Build(2, 2, 1), 1025)
+	if metrics[1][1].Name != "a.2.churn2" {
+		t.Fatalf("expected replaced series to survive resizing, got %q", metrics[1][1].Name)
+	}
+	// 0.5 series per org per interval now
+	if n := c.churn(1040); n != 2 {
+		t.Fatalf("expected 2 series replaced after resizing, got %d", n)
+	}
+}
+
+func TestNewChurner(t *testing.T) {
+	if c, err := newChurner(10, 0); c != nil || err != nil {
+		t.Fatalf("expected no churner and no error when disabled, got %v, %v", c, err)
+	}
+	for _, c := range []struct {
+		pct      float64
+		interval time.Duration
+	}{
+		{0, time.Minute},
+		{101, time.Minute},
+		{10, 1500 * time.Millisecond},
+	} {
+		if _, err := newChurner(c.pct, c.interval); err == nil {
+			t.Errorf("pct %g, interval %s: expected error, got none", c.pct, c.interval)
+		}
+	}
+}
@@ -0,0 +1,278 @@
+// Copyright © 2018 Grafana Labs
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+// the control api lets you change running feeds via the http listener:
+// GET  /status                          the current configuration of all feeds
+// POST /rate?rate=<points/s>[&feed=x]   change the rate of a feed, over all its orgs, by changing the number of series per org.
+//                                       the data time keeps following the clock, so the rate is rounded to a whole number of series.
+// POST /mpo?mpo=<n>[&feed=x]            change the number of series per org of a feed. the rate scales along
+// POST /pause[?feed=x]                  pause a feed, or all feeds. while paused, the points that are due are dropped
+// POST /resume[?feed=x]                 resume a feed, or all feeds
+// the feed parameter may be omitted for /rate and /mpo when only 1 feed is running.
+
+// feedConfig is the part of the configuration of a feed that can be changed at runtime
+type feedConfig struct {
+	Mpo    int     `json:"mpo"`
+	Rate   float64 `json:"rate"` // in points/s, over all orgs. follows from mpo
+	Paused bool    `json:"paused"`
+}
+
+// FeedStatus is the current configuration of a feed, as reported by the control api
+type FeedStatus struct {
+	Name   string `json:"name"`
+	Orgs   int    `json:"orgs"`
+	Period int    `json:"period"` // in s
+	Flush  int    `json:"flush"`  // in ms
+	feedConfig
+	// the factor by which the load profile currently multiplies the number of series
+	Load float64 `json:"load"`
+	// speed of the data time relative to the wall clock. e.g. 1 for realtime, or the speedup for backfills.
+	Speed float64 `json:"speed"`
+	// the amount of points sent so far
+	Points int64 `json:"points"`
+}
+
+// feedControl holds the desired configuration of a feed, which the feed applies on its next tick
+type feedControl struct {
+	sync.Mutex
+	name    string
+	orgs    int
+	period  int
+	flush   int
+	speedup int
+	cfg     feedConfig
+	version int     // bumped on every change
+	load    float64 // as set by the feed
+	points  int64   // accessed atomically
+}
+
+var controls = struct {
+	sync.Mutex
+	feeds map[string]*feedControl
+	once  sync.Once
+}{
+	feeds: make(map[string]*feedControl),
+}
+
+// newFeedControl registers a feed with the control api.
+// if a feed with the same name is already running, the name gets a suffix.
+func newFeedControl(name string, orgs, period, flush, speedup int, cfg feedConfig) *feedControl {
+	controls.once.Do(func() {
+		registerControl(http.DefaultServeMux)
+	})
+	c := &feedControl{
+		orgs:    orgs,
+		period:  period,
+		flush:   flush,
+		speedup: speedup,
+		cfg:     cfg,
+		load:    1,
+	}
+	controls.Lock()
+	c.name = name
+	for i := 2; controls.feeds[c.name] != nil; i++ {
+		c.name = name + "-" + strconv.Itoa(i)
+	}
+	controls.feeds[c.name] = c
+	controls.Unlock()
+	return c
+}
+
+// registerControl registers the handlers of the control api
+func registerControl(mux *http.ServeMux) {
+	mux.HandleFunc("/status", handleStatus)
+	mux.HandleFunc("/rate", handleChange(changeRate))
+	mux.HandleFunc("/mpo", handleChange(changeMpo))
+	mux.HandleFunc("/pause", handleChange(changePaused(true)))
+	mux.HandleFunc("/resume", handleChange(changePaused(false)))
+}
+
+// unregister removes the feed from the control api
+func (c *feedControl) unregister() {
+	controls.Lock()
+	delete(controls.feeds, c.name)
+	controls.Unlock()
+}
+
+// get returns the configuration, and whether it changed since the given version
+func (c *feedControl) get(version int) (feedConfig, int, bool) {
+	c.Lock()
+	defer c.Unlock()
+	return c.cfg, c.version, c.version != version
+}
+
+// setLoad reports the current factor of the load profile
+func (c *feedControl) setLoad(load float64) {
+	c.Lock()
+	c.load = load
+	c.Unlock()
+}
+
+func (c *feedControl) addPoints(n int) {
+	atomic.AddInt64(&c.points, int64(n))
+}
+
+func (c *feedControl) status() FeedStatus {
+	c.Lock()
+	defer c.Unlock()
+	return FeedStatus{
+		Name:       c.name,
+		Orgs:       c.orgs,
+		Period:     c.period,
+		Flush:      c.flush,
+		feedConfig: c.cfg,
+		Load:       c.load,
+		Speed:      float64(c.speedup),
+		Points:     atomic.LoadInt64(&c.points),
+	}
+}
+
+// a change modifies the configuration, based on the request. caller must hold the lock of the feed
+type change func(c *feedControl, r *http.Request) error
+
+// rate returns the rate in points/s of the feed with the given number of series per org
+func (c *feedControl) rate(mpo int) float64 {
+	return float64(c.orgs*mpo*c.speedup) / float64(c.period)
+}
+
+func changeRate(c *feedControl, r *http.Request) error {
+	rate, err := strconv.ParseFloat(r.FormValue("rate"), 64)
+	if err != nil || rate <= 0 {
+		return errors.New("rate must be a number > 0")
+	}
+	mpo := int(math.Round(rate / c.rate(1)))
+	if mpo < 1 {
+		return fmt.Errorf("rate must be at least %g, for 1 series per org", c.rate(1))
+	}
+	c.cfg.Mpo = mpo
+	c.cfg.Rate = c.rate(mpo)
+	return nil
+}
+
+func changeMpo(c *feedControl, r *http.Request) error {
+	mpo, err := strconv.Atoi(r.FormValue("mpo"))
+	if err != nil || mpo < 1 {
+		return errors.New("mpo must be a number >= 1")
+	}
+	if r.FormValue("rate") != "" {
+		return errors.New("rate follows from mpo, so they can't be changed together")
+	}
+	c.cfg.Mpo = mpo
+	c.cfg.Rate = c.rate(mpo)
+	return nil
+}
+
+func changePaused(paused bool) change {
+	return func(c *feedControl, r *http.Request) error {
+		c.cfg.Paused = paused
+		return nil
+	}
+}
+
+// selectFeeds returns the feeds a request applies to: the one named by the feed parameter,
+// or all of them if it is not set and all is true, or the only one.
+// caller must hold the controls lock
+func selectFeeds(r *http.Request, all bool) ([]*feedControl, error) {
+	if name := r.FormValue("feed"); name != "" {
+		c, ok := controls.feeds[name]
+		if !ok {
+			return nil, fmt.Errorf("no feed named %q", name)
+		}
+		return []*feedControl{c}, nil
+	}
+	if !all {
+		if len(controls.feeds) == 0 {
+			return nil, errors.New("no feeds running")
+		}
+		if len(controls.feeds) > 1 {
+			return nil, errors.New("multiple feeds running. specify one with the feed parameter")
+		}
+	}
+	feeds := make([]*feedControl, 0, len(controls.feeds))
+	for _, c := range controls.feeds {
+		feeds = append(feeds, c)
+	}
+	return feeds, nil
+}
+
+func handleStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeStatus(w, r, true)
+}
+
+func handleChange(fn change) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		// pausing and resuming may apply to all feeds at once
+		all := r.URL.Path == "/pause" || r.URL.Path == "/resume"
+		controls.Lock()
+		feeds, err := selectFeeds(r, all)
+		controls.Unlock()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		for _, c := range feeds {
+			c.Lock()
+			err := fn(c, r)
+			if err == nil {
+				c.version++
+			}
+			c.Unlock()
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		writeStatus(w, r, all)
+	}
+}
+
+// writeStatus writes the status of the selected feeds as a json array
+func writeStatus(w http.ResponseWriter, r *http.Request, all bool) {
+	controls.Lock()
+	feeds, err := selectFeeds(r, all)
+	controls.Unlock()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	statuses := make([]FeedStatus, len(feeds))
+	for i, c := range feeds {
+		statuses[i] = c.status()
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Name < statuses[j].Name })
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(statuses)
+}
@@ -0,0 +1,102 @@
+package cmd
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestControlAPI(t *testing.T) {
+	mux := http.NewServeMux()
+	registerControl(mux)
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	c := newFeedControl("control-test", 2, 10, 1000, 1, feedConfig{Mpo: 10, Rate: 2})
+	defer c.unregister()
+
+	// do sends the request, and returns the status code and the decoded status of the feeds
+	do := func(method, path string, params url.Values) (int, []FeedStatus) {
+		req, err := http.NewRequest(method, srv.URL+path+"?"+params.Encode(), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var statuses []FeedStatus
+		if resp.StatusCode == http.StatusOK {
+			if err := json.NewDecoder(resp.Body).Decode(&statuses); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return resp.StatusCode, statuses
+	}
+
+	code, statuses := do("GET", "/status", nil)
+	if code != http.StatusOK || len(statuses) != 1 {
+		t.Fatalf("expected status of 1 feed, got code %d and %v", code, statuses)
+	}
+	if s := statuses[0]; s.Name != "control-test" || s.Mpo != 10 || s.Rate != 2 || s.Speed != 1 {
+		t.Fatalf("unexpected status %+v", s)
+	}
+
+	cases := []struct {
+		method  string
+		path    string
+		params  url.Values
+		expCode int
+		expMpo  int
+		expRate float64
+	}{
+		{"POST", "/rate", url.Values{"rate": {"5"}}, http.StatusOK, 25, 5},
+		// the rate is rounded to a whole number of series
+		{"POST", "/rate", url.Values{"rate": {"3.35"}}, http.StatusOK, 17, 3.4},
+		{"POST", "/rate", url.Values{"rate": {"0.05"}}, http.StatusBadRequest, 17, 3.4},
+		{"POST", "/rate", url.Values{"rate": {"fast"}}, http.StatusBadRequest, 17, 3.4},
+		{"POST", "/rate", url.Values{"rate": {"-1"}}, http.StatusBadRequest, 17, 3.4},
+		{"GET", "/rate", url.Values{"rate": {"5"}}, http.StatusMethodNotAllowed, 17, 3.4},
+		{"POST", "/rate", url.Values{"rate": {"5"}, "feed": {"other"}}, http.StatusBadRequest, 17, 3.4},
+		{"POST", "/mpo", url.Values{"mpo": {"40"}}, http.StatusOK, 40, 8},
+		{"POST", "/mpo", url.Values{"mpo": {"0"}}, http.StatusBadRequest, 40, 8},
+		{"POST", "/mpo", url.Values{"mpo": {"many"}}, http.StatusBadRequest, 40, 8},
+		{"POST", "/mpo", url.Values{"mpo": {"5"}, "rate": {"10"}}, http.StatusBadRequest, 40, 8},
+		{"POST", "/mpo", url.Values{"mpo": {"5"}, "feed": {"control-test"}}, http.StatusOK, 5, 1},
+	}
+	for _, c := range cases {
+		code, statuses := do(c.method, c.path, c.params)
+		if code != c.expCode {
+			t.Fatalf("%s %s?%s: expected code %d, got %d", c.method, c.path, c.params.Encode(), c.expCode, code)
+		}
+		if code == http.StatusOK && (len(statuses) != 1 || statuses[0].Mpo != c.expMpo || statuses[0].Rate != c.expRate) {
+			t.Fatalf("%s %s?%s: expected mpo %d and rate %g, got %v", c.method, c.path, c.params.Encode(), c.expMpo, c.expRate, statuses)
+		}
+		_, statuses = do("GET", "/status", nil)
+		if s := statuses[0]; s.Mpo != c.expMpo || s.Rate != c.expRate {
+			t.Fatalf("%s %s?%s: expected mpo %d and rate %g afterwards, got %+v", c.method, c.path, c.params.Encode(), c.expMpo, c.expRate, s)
+		}
+	}
+
+	code, statuses = do("POST", "/pause", nil)
+	if code != http.StatusOK || !statuses[0].Paused {
+		t.Fatalf("expected the feed to be paused, got code %d and %v", code, statuses)
+	}
+	if code, _ := do("POST", "/status", nil); code != http.StatusMethodNotAllowed {
+		t.Fatalf("expected POST /status not to be allowed, got code %d", code)
+	}
+
+	// with more than 1 feed, changes must name the feed
+	c2 := newFeedControl("control-test", 1, 1, 1000, 1, feedConfig{Mpo: 1, Rate: 1})
+	defer c2.unregister()
+	if code, _ := do("POST", "/mpo", url.Values{"mpo": {"2"}}); code != http.StatusBadRequest {
+		t.Fatalf("expected an error without feed parameter, got code %d", code)
+	}
+	code, statuses = do("POST", "/mpo", url.Values{"mpo": {"2"}, "feed": {"control-test-2"}})
+	if code != http.StatusOK || len(statuses) != 1 || statuses[0].Mpo != 2 {
+		t.Fatalf("expected the second feed to change, got code %d and %v", code, statuses)
+	}
+}
@@ -1,9 +1,11 @@
 package cmd
 
 import (
+	"errors"
 	"fmt"
 	"math/rand"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/grafana/metrictank/schema"
@@ -48,20 +50,70 @@ func (tb SimpleBuilder) Build(orgs, mpo, period int) [][]schema.MetricData {
 
 // uses tags
 type TaggedBuilder struct {
-	metricName string
+	metricName          string
+	addTags             bool
+	numUniqueTags       int
+	customTags          []string
+	numUniqueCustomTags int
+	tagCardinality      []tagCardinality
+	// seed for sampling the tag sets. every Build with the same seed gives the same series
+	seed int64
+}
+
+// newTaggedBuilder returns a TaggedBuilder based on the flags
+func newTaggedBuilder() (TaggedBuilder, error) {
+	card, err := parseTagCardinality(tagCardinalitySpec)
+	if err != nil {
+		return TaggedBuilder{}, err
+	}
+	tb := TaggedBuilder{metricName, addTags, numUniqueTags, customTags, numUniqueCustomTags, card, newRand().Int63()}
+	return tb, tb.validate()
 }
 
 func (tb TaggedBuilder) Info() string {
+	if len(tb.tagCardinality) > 0 {
+		card := make([]string, len(tb.tagCardinality))
+		for i, t := range tb.tagCardinality {
+			card[i] = t.String()
+		}
+		return "metricName=" + tb.metricName + ", tags=" + strings.Join(card, ",")
+	}
 	return "metricName=" + tb.metricName
 }
 
+// validate checks the tag settings of the builder
+func (tb TaggedBuilder) validate() error {
+	if tb.addTags && len(tb.customTags) > 0 {
+		return errors.New("cannot use regular-tags and custom-tags at the same time")
+	}
+
+	if len(tb.tagCardinality) > 0 && (tb.addTags || len(tb.customTags) > 0) {
+		return errors.New("cannot use tag-cardinality together with regular-tags or custom-tags")
+	}
+
+	if tb.numUniqueTags > 10 || tb.numUniqueTags < 0 {
+		return fmt.Errorf("num-unique-tags must be a value between 0 and 10, you entered %d", tb.numUniqueTags)
+	}
+
+	if tb.numUniqueCustomTags > len(tb.customTags) || tb.numUniqueCustomTags < 0 {
+		return fmt.Errorf("num-unique-custom-tags must be a value between 0 and %d, you entered %d", len(tb.customTags), tb.numUniqueCustomTags)
+	}
+	return nil
+}
+
 func (tb TaggedBuilder) Build(orgs, mpo, period int) [][]schema.MetricData {
+	if err := tb.validate(); err != nil {
+		panic(err.Error())
+	}
+	if len(tb.tagCardinality) > 0 {
+		return tb.buildCardinality(orgs, mpo, period)
+	}
 	out := make([][]schema.MetricData, orgs)
 	for o := 0; o < orgs; o++ {
 		metrics := make([]schema.MetricData, mpo)
 		for m := 0; m < mpo; m++ {
 			var tags []string
-			name := fmt.Sprintf("%s.%d", metricName, m+1)
+			name := fmt.Sprintf("%s.%d", tb.metricName, m+1)
 
 			localTags := []string{
 				"secondkey=anothervalue",
@@ -76,26 +128,26 @@ func (tb TaggedBuilder) Build(orgs, mpo, period int) [][]schema.MetricData {
 				"goodforpeoplewhojustusetags=forbasicallyeverything",
 			}
 
-			if len(customTags) > 0 {
-				if numUniqueCustomTags > 0 {
+			if len(tb.customTags) > 0 {
+				if tb.numUniqueCustomTags > 0 {
 					var j int
-					for j = 0; j < numUniqueCustomTags; j++ {
-						tags = append(tags, customTags[j]+strconv.Itoa(m+1))
+					for j = 0; j < tb.numUniqueCustomTags; j++ {
+						tags = append(tags, tb.customTags[j]+strconv.Itoa(m+1))
 					}
-					for j < len(customTags) {
-						tags = append(tags, customTags[j])
+					for j < len(tb.customTags) {
+						tags = append(tags, tb.customTags[j])
 						j++
 					}
 
 				} else {
-					tags = customTags
+					tags = tb.customTags
 				}
 			}
 
-			if addTags {
-				if numUniqueTags > 0 {
+			if tb.addTags {
+				if tb.numUniqueTags > 0 {
 					var j int
-					for j = 0; j < numUniqueTags; j++ {
+					for j = 0; j < tb.numUniqueTags; j++ {
 						tags = append(tags, localTags[j]+strconv.Itoa(m+1))
 					}
 					for j < len(localTags) {
@@ -121,6 +173,43 @@ func (tb TaggedBuilder) Build(orgs, mpo, period int) [][]schema.MetricData {
 	return out
 }
 
+// buildCardinality builds series with tag sets sampled from the tag cardinality model.
+// all orgs get the same series.
+func (tb TaggedBuilder) buildCardinality(orgs, mpo, period int) [][]schema.MetricData {
+	n := mpo
+	if p := crossProduct(tb.tagCardinality); n > p {
+		n = p
+	}
+	sets := sampleTagSets(tb.tagCardinality, n, rand.New(rand.NewSource(tb.seed)))
+	out := make([][]schema.MetricData, orgs)
+	for o := 0; o < orgs; o++ {
+		metrics := make([]schema.MetricData, mpo)
+		for m := 0; m < mpo; m++ {
+			set := sets[m%n]
+			tags := make([]string, len(set))
+			for i, v := range set {
+				tags[i] = tb.tagCardinality[i].tag(v)
+			}
+			name := tb.metricName
+			// beyond the cross-product, the tag sets repeat, so the name must tell the series apart
+			if mpo > n {
+				name = fmt.Sprintf("%s.%d", tb.metricName, m/n+1)
+			}
+			metrics[m] = schema.MetricData{
+				Name:     name,
+				OrgId:    o + 1,
+				Interval: period,
+				Unit:     "ms",
+				Mtype:    "gauge",
+				Tags:     tags,
+			}
+			metrics[m].SetId()
+		}
+		out[o] = metrics
+	}
+	return out
+}
+
 // examples (everything perOrg)
 // num metrics - flush (s) - period (s) - speedup -> ratePerSPerOrg      -> ratePerFlushPerOrg
 // mpo         -                                     mpo*speedup/period  -> mpo*speedup*flush/period
@@ -131,54 +220,226 @@ func (tb TaggedBuilder) Build(orgs, mpo, period int) [][]schema.MetricData {
 // mpo         - 2           1            1          mpo                    mpo*2            2x -> flush 2x                  runMultiplied
 // mpo         - 2           1            2          mpo*2                  mpo*2            4x -> flush 4x                  runMultiplied
 
-// dataFeed supports both realtime, as backfill, with speedup
-// important:
-// period in seconds
-// flush  in ms
-// offset in seconds
-func dataFeed(outs []out.Out, orgs, mpo, period, flush, offset, speedup int, stopAtNow bool, builder MetricPayloadBuilder) {
-	flushDur := time.Duration(flush) * time.Millisecond
+// when ratePerFlushPerOrg is not a whole number, the fractional remainder is carried over
+// to the next flush, so that some flushes send one more point than others, but the
+// rate over time is exact.
 
-	if mpo*speedup%period != 0 {
-		panic("not a good fit. mpo*speedup must divide by period, to compute clean rate/s/org")
+// pacer tracks how many points per org to send each flush.
+// to keep the rate exact, it counts in units of 1/(1000*period) points:
+// each flush adds mpo*speedup*flush of those, of which the whole points are sent
+// and the remainder is kept for the next flush.
+type pacer struct {
+	acc      int64
+	perFlush int64
+	unit     int64
+}
+
+func newPacer(mpo, period, flush, speedup int) *pacer {
+	return &pacer{
+		perFlush: int64(mpo) * int64(speedup) * int64(flush),
+		unit:     int64(1000) * int64(period),
 	}
-	ratePerSPerOrg := mpo * speedup / period
+}
 
-	if mpo*speedup*flush%(1000*period) != 0 {
-		panic("not a good fit. mpo*speedup*flush must divide by period, to compute clean rate/flush/org")
+// next returns the amount of points per org to send in the next flush
+func (p *pacer) next() int64 {
+	p.acc += p.perFlush
+	num := p.acc / p.unit
+	p.acc -= num * p.unit
+	return num
+}
+
+// checkRate validates the parameters that determine the rate of a feed
+func checkRate(orgs, mpo, period, flush, speedup int) error {
+	if orgs < 1 {
+		return fmt.Errorf("orgs must be at least 1, you entered %d", orgs)
+	}
+	if mpo < 1 {
+		return fmt.Errorf("mpo must be at least 1, you entered %d", mpo)
+	}
+	if period < 1 {
+		return fmt.Errorf("period must be at least 1s, you entered %ds", period)
 	}
-	ratePerFlushPerOrg := ratePerSPerOrg * flush / 1000
+	if flush < 1 {
+		return fmt.Errorf("flush must be at least 1ms, you entered %dms", flush)
+	}
+	if speedup < 1 {
+		return fmt.Errorf("speedup must be at least 1, you entered %d", speedup)
+	}
+	return nil
+}
 
-	if addTags && len(customTags) > 0 {
-		panic("cannot use regular-tags and custom-tags at the same time")
+// resizeSeries returns the series per org and their multiples of the period, resized to n series per org.
+// the series we already had keep their identity and interval, otherwise a resize would look like churn.
+func resizeSeries(base [][]schema.MetricData, mults []int, n, period int, builder MetricPayloadBuilder, dist *IntervalDistribution) ([][]schema.MetricData, []int) {
+	if n <= len(mults) {
+		return shrinkSeries(base, n), mults[:n]
 	}
+	base = growSeries(base, builder.Build(len(base), n, period), n)
+	mults = append(mults[:len(mults):len(mults)], dist.assign(n, period)[len(mults):]...)
+	setIntervals(base, mults, period)
+	return base, mults
+}
+
+// growSeries returns the series per org, extended to n series with the series from fresh that we don't have yet.
+// fresh must be built for n series per org. the series we have stay as they are, even if fresh
+// would have given them another position, which happens with sampled tag sets.
+func growSeries(metrics, fresh [][]schema.MetricData, n int) [][]schema.MetricData {
+	out := make([][]schema.MetricData, len(metrics))
+	for o := range metrics {
+		have := make(map[string]bool, n)
+		out[o] = make([]schema.MetricData, len(metrics[o]), n)
+		copy(out[o], metrics[o])
+		for _, md := range metrics[o] {
+			have[seriesKey(md)] = true
+		}
+		for _, md := range fresh[o] {
+			if len(out[o]) == n {
+				break
+			}
+			if !have[seriesKey(md)] {
+				out[o] = append(out[o], md)
+			}
+		}
+	}
+	return out
+}
 
-	if numUniqueTags > 10 || numUniqueTags < 0 {
-		panic(fmt.Sprintf("num-unique-tags must be a value between 0 and 10, you entered %d", numUniqueTags))
+// shrinkSeries returns the first n series per org
+func shrinkSeries(metrics [][]schema.MetricData, n int) [][]schema.MetricData {
+	out := make([][]schema.MetricData, len(metrics))
+	for o := range metrics {
+		out[o] = metrics[o][:n]
 	}
+	return out
+}
+
+// seriesKey identifies a series as built, regardless of its interval
+func seriesKey(md schema.MetricData) string {
+	return md.Name + ";" + strings.Join(md.Tags, ";")
+}
+
+// feedOptions are the optional settings of a feed. the zero value gives a plain realtime feed.
+type feedOptions struct {
+	offset    int // in seconds
+	speedup   int // 0 means 1
+	stopAtNow bool
+	maxLag    time.Duration         // if > 0, the feed fails when it falls further behind schedule than that
+	profile   LoadProfile           // the load follows the profile, if not nil
+	churn     *churner              // series get replaced by the churner, if not nil
+	dist      *IntervalDistribution // series get their interval from the distribution, or the period if nil
+	faults    *faultInjector        // points get faults injected, if not nil
+}
+
+// dataFeed supports both realtime, as backfill, with speedup
+// important:
+// period in seconds
+// flush  in ms
+// the feed runs until the limit ends it (if not nil), or until now is reached if opts.stopAtNow
+// the feed can be changed at runtime through the control api, under the given name.
+func dataFeed(name string, outs []out.Out, orgs, mpo, period, flush int, builder MetricPayloadBuilder, vg ValueGenerator, opts feedOptions, lim *runLimit) error {
+	offset, speedup, stopAtNow, maxLag := opts.offset, opts.speedup, opts.stopAtNow, opts.maxLag
+	profile, churn, dist, faults := opts.profile, opts.churn, opts.dist, opts.faults
+	if speedup == 0 {
+		speedup = 1
+	}
+	if err := checkRate(orgs, mpo, period, flush, speedup); err != nil {
+		return err
+	}
+	if dist == nil {
+		dist = &IntervalDistribution{kind: "fixed"}
+	}
+	if err := dist.check(period); err != nil {
+		return err
+	}
+	if err := faults.useOutputs(outs); err != nil {
+		return err
+	}
+	flushDur := time.Duration(flush) * time.Millisecond
+
+	ratePerSPerOrg := float64(mpo*speedup) / float64(period)
+	ratePerFlushPerOrg := ratePerSPerOrg * float64(flush) / 1000
 
-	if numUniqueCustomTags > len(customTags) || numUniqueCustomTags < 0 {
-		panic(fmt.Sprintf("num-unique-custom-tags must be a value between 0 and %d, you entered %d", len(customTags), numUniqueCustomTags))
+	ratePerS := ratePerSPerOrg * float64(orgs)
+	ratePerFlush := ratePerFlushPerOrg * float64(orgs)
+
+	if profile == nil {
+		profile = FlatProfile{}
 	}
 
-	ratePerS := ratePerSPerOrg * orgs
-	ratePerFlush := ratePerFlushPerOrg * orgs
+	// the load profile varies the amount of series that send points: of the pool of series,
+	// only the first active ones do. the others skip their turn, like series with a longer interval.
+	// that way, the timestamps keep advancing at the pace of the clock, whatever the load.
+	pool := poolSize(mpo, profile)
+
+	// the intervals of the series are multiples of the period, in which they skip their turn
+	mults := dist.assign(pool, period)
+	dens := density(mults[:mpo])
 
-	tmpl := `params: %s, orgs=%d, mpo=%d, period=%d, flush=%d, offset=%d, speedup=%d, stopAtNow=%t
-per org:         each %s, flushing %d metrics so rate of %d Hz. (%d total unique series)
-times %4d orgs: each %s, flushing %d metrics so rate of %d Hz. (%d total unique series)
+	tmpl := `params: %s, values=%s, load=%s, intervals=%s, faults=%s, orgs=%d, mpo=%d, period=%d, flush=%d, offset=%d, speedup=%d, stopAtNow=%t
+per org:         each %s, flushing %.6g metrics so rate of %.6g Hz. (%d total unique series)
+times %4d orgs: each %s, flushing %.6g metrics so rate of %.6g Hz. (%d total unique series)
 `
-	fmt.Printf(tmpl, builder.Info(), orgs, mpo, period, flush, offset, speedup, stopAtNow,
+	fmt.Printf(tmpl, builder.Info(), vg.Info(), profile.Info(), dist.Info(), faults.Info(), orgs, mpo, period, flush, offset, speedup, stopAtNow,
 		flushDur, ratePerFlush, ratePerS, orgs*mpo,
 		orgs, flushDur, ratePerFlush, ratePerS, orgs*mpo)
+	if dens < 1 {
+		fmt.Printf("series with a longer interval skip their turn, so the actual rate is %.6g Hz\n", ratePerS*dens)
+	}
+	if pool > mpo {
+		fmt.Printf("the load profile needs up to %d series per org\n", pool)
+	}
 
+	begin := time.Now()
+	factor := profile.Factor(0)
 	tick := time.NewTicker(flushDur)
+	paused := false
+	ctl := newFeedControl(name, orgs, period, flush, speedup, feedConfig{mpo, ratePerS, paused})
+	defer ctl.unregister()
+
+	// active is the amount of series per org that send points, and created the most there have been.
+	active, created := 0, 0
+	setActive := func(n int) {
+		seriesActive.Inc(int64(orgs * (n - active)))
+		if n > created {
+			seriesCreated.Inc(int64(orgs * (n - created)))
+			created = n
+		}
+		active = n
+	}
+	setActive(activeSeries(mpo, pool, factor))
+	defer func() { seriesActive.Dec(int64(orgs * active)) }()
 
-	metrics := builder.Build(orgs, mpo, period)
+	// target is what we contribute to the target rate, and must be updated whenever the active series change
+	var target float64
+	updateTarget := func() {
+		var t float64
+		if active > 0 {
+			t = float64(orgs*speedup*active) / float64(period) * density(mults[:active])
+		}
+		recorded.addTargetRate(t - target)
+		target = t
+	}
+	updateTarget()
+	// once we're done, we no longer contribute to the target rate
+	defer func() { recorded.addTargetRate(-target) }()
+	var version int
 
 	mp := int64(period)
-	ts := time.Now().Unix() - int64(offset) - mp
-	startFrom := 0
+	start := time.Now().Unix() - int64(offset)
+	ts := start - mp
+	lag := newLagTracker(name, begin, time.Unix(start, 0), speedup, flushDur)
+	defer lag.done()
+
+	// base are the series as built, with their intervals. metrics have the churn applied
+	base := builder.Build(orgs, pool, period)
+	setIntervals(base, mults, period)
+	metrics := churn.init(base, start)
+
+	pace := newPacer(pool, period, flush, speedup)
+	ctl.setLoad(factor)
+	// amount of positions passed so far, per org. every cycle through the pool, the timestamp increases by the period
+	var sent int64
 
 	// huh what if we increment ts beyond the now ts?
 	// this can only happen if we repeatedly loop, and bump ts each time
@@ -191,33 +452,81 @@ times %4d orgs: each %s, flushing %d metrics so rate of %d Hz. (%d total unique
 	// (ceil(speedup * flush /period)-1)*period < flush
 	// (ceil(speedup * flush - period ) < flush
 
-	for nowT := range tick.C {
+	for {
+		var nowT time.Time
+		select {
+		case <-lim.Done():
+			tick.Stop()
+			return nil
+		case nowT = <-tick.C:
+		}
 		now := nowT.Unix()
-		var data []*schema.MetricData
-
-		for o := 0; o < len(metrics); o++ {
-			// as seen above, we need to flush ratePerFlushPerOrg
-			// respecting where a previous flush left off, we need to start from
-			// the point after it.
-			var m int
-			for num := 0; num < ratePerFlushPerOrg; num++ {
-				// note that ratePerFlushPerOrg may be any of >, =, < mpo
-				// it all depends on what the user requested
-				// the main thing we need to watch out for here is to bump the timestamp
-				// is properly bumped in both cases
-				m = (startFrom + num) % mpo
+
+		if cfg, v, changed := ctl.get(version); changed {
+			version = v
+			if cfg.Mpo != mpo {
+				// continue at the same position in the cycle, with the new pool of series
+				newPool := poolSize(cfg.Mpo, profile)
+				sent = sent/int64(pool)*int64(newPool) + sent%int64(pool)*int64(newPool)/int64(pool)
+				mpo, pool = cfg.Mpo, newPool
+				ratePerS = float64(orgs*mpo*speedup) / float64(period)
+				base, mults = resizeSeries(base, mults, pool, period, builder, dist)
+				metrics = churn.init(base, start)
+				pace = newPacer(pool, period, flush, speedup)
+				setActive(activeSeries(mpo, pool, factor))
+			}
+			updateTarget()
+			paused = cfg.Paused
+			log.Info("%s: now using mpo=%d, rate=%.6g points/s, paused=%t", name, mpo, ratePerS, paused)
+		}
+
+		if f := profile.Factor(nowT.Sub(begin)); f != factor {
+			factor = f
+			setActive(activeSeries(mpo, pool, factor))
+			updateTarget()
+			ctl.setLoad(f)
+		}
+
+		// churn based on the ts of the next point to send
+		if n := churn.churn(start + sent/int64(pool)*mp); n > 0 {
+			seriesCreated.Inc(int64(n))
+			log.Debug("%s: replaced %d series", name, n)
+		}
+
+		num := pace.next()
+
+		var data, full []*schema.MetricData
+		if num > 0 {
+			// every time we've cycled through the pool, we must increase the timestamp
+			ts = start + (sent+num-1)/int64(pool)*mp
+		}
+		// while paused, the points that are due are dropped, so that the data stays in sync with the clock
+		for o := 0; o < len(metrics) && !paused; o++ {
+			for p := sent; p < sent+num; p++ {
+				m := int(p % int64(pool))
+				cycle := p / int64(pool)
+				if m >= active || cycle%int64(mults[m]) != 0 {
+					continue
+				}
 				metricData := metrics[o][m]
-				// not the very first metric, but we "cycled back" to reusing metrics
-				// we already sent, so we must increase the timestamp
-				if m == 0 {
-					ts += mp
+				metricData.Time = start + cycle*mp
+				metricData.Value = vg.Value(o, m, metricData.Time)
+				send, inFull := faults.apply(o, m, &metricData)
+				if !send {
+					continue
+				}
+				if inFull {
+					full = append(full, &metricData)
+					continue
 				}
-				metricData.Time = ts
-				metricData.Value = rand.Float64() * float64(m+1)
 				data = append(data, &metricData)
 			}
-			startFrom = (m + 1) % mpo
 		}
+		sent += num
+		data = data[:lim.take(len(data))]
+		full = full[:lim.take(len(full))]
+		pointsGenerated.Inc(int64(len(data) + len(full)))
+		ctl.addPoints(len(data) + len(full))
 
 		preFlush := time.Now()
 		for _, out := range outs {
@@ -226,10 +535,28 @@ times %4d orgs: each %s, flushing %d metrics so rate of %d Hz. (%d total unique
 				log.Error(0, err.Error())
 			}
 		}
+		faults.flushFull(outs, full)
+		faults.flushRaw(outs)
 		flushDuration.Value(time.Since(preFlush))
+		if time.Since(nowT) > flushDur {
+			behindTicks.Inc(1)
+		}
+		// the data time up to which we generated points: the position in the current cycle through the pool
+		generated := time.Unix(start, 0).Add(time.Duration(sent/int64(pool)*mp)*time.Second + time.Duration(sent%int64(pool)*mp)*time.Second/time.Duration(pool))
+		if l := lag.tick(time.Now(), generated); maxLag > 0 && l > maxLag {
+			tick.Stop()
+			return fmt.Errorf("feed is lagging %s behind schedule, more than the max lag of %s", l, maxLag)
+		}
 
 		if ts >= now && stopAtNow {
-			return
+			tick.Stop()
+			return nil
+		}
+		select {
+		case <-lim.Done():
+			tick.Stop()
+			return nil
+		default:
 		}
 	}
 }
@@ -0,0 +1,182 @@
+package cmd
+
+import (
+	"math/rand"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/grafana/metrictank/schema"
+	"github.com/raintank/fakemetrics/out"
+	"github.com/raintank/fakemetrics/promstats"
+)
+
+func TestPacer(t *testing.T) {
+	cases := []struct {
+		mpo, period, flush, speedup int
+		flushes                     int
+		exp                         int64
+	}{
+		{100, 1, 1000, 1, 10, 1000},
+		{1000, 10, 300, 1, 100, 3000},
+		{7, 3, 100, 1, 90, 21},
+		{7, 3, 100, 5, 90, 105},
+		{1, 60, 1000, 1, 59, 0},
+		{1, 60, 1000, 1, 60, 1},
+	}
+	for i, c := range cases {
+		p := newPacer(c.mpo, c.period, c.flush, c.speedup)
+		var total int64
+		for f := 0; f < c.flushes; f++ {
+			num := p.next()
+			if num < 0 {
+				t.Fatalf("case %d: flush %d got negative amount %d", i, f, num)
+			}
+			total += num
+		}
+		if total != c.exp {
+			t.Fatalf("case %d: expected %d points after %d flushes, got %d", i, c.exp, c.flushes, total)
+		}
+	}
+}
+
+// initTestStats sets up the global stats, recorded in-process
+func initTestStats() *recorder {
+	r := newRecorder(promstats.New())
+	recorded = r
+	flushDuration = r.NewTimer("metricpublisher.global.flush_duration", 0)
+	pointsGenerated = r.NewCount("metricpublisher.global.points_generated")
+	behindTicks = r.NewCount("metricpublisher.global.behind_ticks")
+	missedTicks = r.NewGauge("metricpublisher.global.missed_ticks", 0)
+	lagMs = r.NewGauge("metricpublisher.global.lag_ms", 0)
+	seriesActive = r.NewGauge("metricpublisher.global.series_active", 0)
+	seriesCreated = r.NewCount("metricpublisher.global.series_created")
+	faultStats = newFaultCounters(r)
+	return r
+}
+
+// clockOut checks that no point is timestamped after the time of the flush
+type clockOut struct {
+	sync.Mutex
+	points int
+	series map[string]bool
+	future int
+}
+
+func (c *clockOut) Close() error { return nil }
+func (c *clockOut) Flush(metrics []*schema.MetricData) error {
+	c.Lock()
+	defer c.Unlock()
+	now := time.Now().Unix()
+	for _, md := range metrics {
+		if md.Time > now {
+			c.future++
+		}
+		c.series[md.Name] = true
+	}
+	c.points += len(metrics)
+	return nil
+}
+
+func TestDataFeedBurstKeepsClock(t *testing.T) {
+	initTestStats()
+	o := &clockOut{series: make(map[string]bool)}
+	// bursts of 10x for 900ms of every second, after the first second:
+	// if the bursts sped up the data time, it would run seconds ahead
+	profile := BurstProfile{factor: 10, duration: 900 * time.Millisecond, every: time.Second}
+	lim := newRunLimit(2500*time.Millisecond, 0)
+	err := dataFeed("burst-test", []out.Out{o}, 1, 10, 1, 100, SimpleBuilder{"a"}, RandomValues{rand.New(rand.NewSource(1))}, feedOptions{profile: profile}, lim)
+	if err != nil {
+		t.Fatal(err)
+	}
+	o.Lock()
+	defer o.Unlock()
+	if o.future > 0 {
+		t.Fatalf("expected no points with a timestamp after the time of sending, got %d of %d", o.future, o.points)
+	}
+	if len(o.series) <= 10 {
+		t.Fatalf("expected the burst to make more than 10 series send points, got %d", len(o.series))
+	}
+	// 10 points/s, and 100 points/s during the bursts
+	if o.points < 100 || o.points > 200 {
+		t.Fatalf("expected about 150 points, got %d", o.points)
+	}
+}
+
+// fullOut counts the points flushed normally and in full
+type fullOut struct {
+	sync.Mutex
+	points, full int
+}
+
+func (f *fullOut) Close() error { return nil }
+func (f *fullOut) Flush(metrics []*schema.MetricData) error {
+	f.Lock()
+	defer f.Unlock()
+	f.points += len(metrics)
+	return nil
+}
+func (f *fullOut) FlushFull(metrics []*schema.MetricData) error {
+	f.Lock()
+	defer f.Unlock()
+	f.full += len(metrics)
+	return nil
+}
+
+func TestDataFeedSendsFaultsInFull(t *testing.T) {
+	r := initTestStats()
+	o := &fullOut{}
+	faults, err := newFaultInjector("id-mismatch=0.5,out-of-order=0.2", rand.New(rand.NewSource(1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lim := newRunLimit(0, 1000)
+	err = dataFeed("full-test", []out.Out{o}, 1, 100, 1, 100, SimpleBuilder{"a"}, RandomValues{rand.New(rand.NewSource(1))}, feedOptions{offset: 3600, speedup: 100, faults: faults}, lim)
+	if err != nil {
+		t.Fatal(err)
+	}
+	o.Lock()
+	defer o.Unlock()
+	// out-of-order points only have another timestamp, so they are sent normally
+	if mismatch := r.count("metricpublisher.global.faults_id_mismatch"); int64(o.full) != mismatch || o.points+o.full != 1000 {
+		t.Fatalf("expected the %d points with id-mismatch sent in full out of 1000, got %d in full and %d others", mismatch, o.full, o.points)
+	}
+}
+
+func TestResizeSeriesKeepsSeries(t *testing.T) {
+	card, err := parseTagCardinality("region:3,host:50")
+	if err != nil {
+		t.Fatal(err)
+	}
+	builder := TaggedBuilder{metricName: "a", tagCardinality: card, seed: 1}
+	dist, err := NewIntervalDistribution("zipf:s=1,max=1m", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	base := builder.Build(2, 10, 1)
+	mults := dist.assign(10, 1)
+	setIntervals(base, mults, 1)
+
+	for _, n := range []int{25, 7, 7, 140, 12} {
+		resized, newMults := resizeSeries(base, mults, n, 1, builder, &dist)
+		if len(resized) != 2 || len(resized[1]) != n || len(newMults) != n {
+			t.Fatalf("resize to %d: expected 2 orgs of %d series, got %d orgs of %d series and %d intervals", n, n, len(resized), len(resized[1]), len(newMults))
+		}
+		for o := range resized {
+			ids := make(map[string]bool)
+			for m, md := range resized[o] {
+				if ids[md.Id] {
+					t.Fatalf("resize to %d: duplicate series %s", n, md.Id)
+				}
+				ids[md.Id] = true
+				if md.Interval != newMults[m] {
+					t.Fatalf("resize to %d: series %d has interval %d, expected %d", n, m, md.Interval, newMults[m])
+				}
+				if m < len(base[o]) && (md.Id != base[o][m].Id || md.Interval != base[o][m].Interval) {
+					t.Fatalf("resize to %d: series %d changed from %s with interval %d to %s with interval %d", n, m, base[o][m].Id, base[o][m].Interval, md.Id, md.Interval)
+				}
+			}
+		}
+		base, mults = resized, newMults
+	}
+}
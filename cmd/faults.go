@@ -0,0 +1,467 @@
+package cmd
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"strings"
+	"time"
+
+	"github.com/grafana/metrictank/schema"
+	"github.com/raintank/fakemetrics/out"
+	"github.com/raintank/met"
+	"github.com/raintank/worldping-api/pkg/log"
+)
+
+const faultsHelp = "data quality faults to inject into every series, as comma separated key=value params: " +
+	"drop=<probability of dropping a point>, gap=<probability of a gap starting at a point>, gap-length=<points per gap, default 10>, " +
+	"nan=<probability of a NaN value>, inf=<probability of a +Inf or -Inf value>, float32-overflow=<probability of a value beyond the range of a float32>. " +
+	"outputs whose protocol can't represent NaN or infinite values (influx, opentsdb over http, carbon plain and statsd) skip and count those points. " +
+	"invalid data, at most one kind per point: invalid-timestamp, invalid-interval, invalid-orgid, invalid-name, invalid-mtype, invalid-tags, " +
+	"out-of-order (a timestamp out-of-order-by points, default 5, before the last one sent), duplicate (the timestamp of the last one sent), " +
+	"far-future (a timestamp far-future-by ahead, default 8760h), too-old (a timestamp too-old-by back, default 87600h, to be older than the retention), " +
+	"long-name and long-tag-value (of long-length characters, default 65536), unicode-name (with unicode and control characters), " +
+	"huge-tag-count (tag-count extra tags, default 1000), id-mismatch (an id that is not derived from the name), conflicting-interval (another interval for the same name and tags) " +
+	"and malformed-msgp (a corrupt msgp payload, sent as is by the kafka outputs, which are required for it), each with the probability of a point getting it. " +
+	"points with invalid properties other than the timestamp are always sent as full MetricData, also with the metricpoint formats. " +
+	"e.g. 'drop=0.01,gap=0.001,gap-length=30,nan=0.001,invalid-orgid=0.01'. all of them are counted in the stats"
+
+// faultCounters count the injected faults
+type faultCounters struct {
+	dropped   met.Count
+	gaps      met.Count
+	gapPoints met.Count // points skipped because of gaps
+	nan       met.Count
+	inf       met.Count
+	overflow  met.Count
+	invalid   map[string]met.Count // per invalid class
+}
+
+func newFaultCounters(stats met.Backend) faultCounters {
+	invalid := make(map[string]met.Count)
+	for _, c := range invalidClasses {
+		invalid[c.key] = stats.NewCount(c.stat())
+	}
+	return faultCounters{
+		dropped:   stats.NewCount("metricpublisher.global.faults_dropped"),
+		gaps:      stats.NewCount("metricpublisher.global.faults_gaps"),
+		gapPoints: stats.NewCount("metricpublisher.global.faults_gap_points"),
+		nan:       stats.NewCount("metricpublisher.global.faults_nan"),
+		inf:       stats.NewCount("metricpublisher.global.faults_inf"),
+		overflow:  stats.NewCount("metricpublisher.global.faults_float32_overflow"),
+		invalid:   invalid,
+	}
+}
+
+// invalidClass is a kind of invalid data to inject into points
+type invalidClass struct {
+	key string
+	// full is whether the point must be sent as full MetricData, because the invalid data is in
+	// properties that compact formats such as MetricPoint don't have, so that they would drop it.
+	full bool
+	// apply makes the point invalid, given the state of its series.
+	// it returns false if it can't be applied to this point, e.g. a duplicate of the first point of a series.
+	apply func(f *faultInjector, s *seriesFaults, md *schema.MetricData) bool
+}
+
+// stat returns the key of the stat that counts the points with this kind of invalid data
+func (c invalidClass) stat() string {
+	return "metricpublisher.global.faults_" + strings.Replace(c.key, "-", "_", -1)
+}
+
+// invalidClasses are all kinds of invalid data, in the order in which they are drawn
+var invalidClasses = []invalidClass{
+	{"invalid-timestamp", false, func(f *faultInjector, s *seriesFaults, md *schema.MetricData) bool {
+		md.Time = 0 // 0 or >= math.MaxInt32
+		return true
+	}},
+	{"invalid-interval", true, func(f *faultInjector, s *seriesFaults, md *schema.MetricData) bool {
+		md.Interval = 0 // 0 or >= math.MaxInt32
+		md.SetId()
+		return true
+	}},
+	{"invalid-orgid", true, func(f *faultInjector, s *seriesFaults, md *schema.MetricData) bool {
+		md.OrgId = 0
+		md.SetId()
+		return true
+	}},
+	{"invalid-name", true, func(f *faultInjector, s *seriesFaults, md *schema.MetricData) bool {
+		md.Name = ""
+		md.SetId()
+		return true
+	}},
+	{"invalid-mtype", true, func(f *faultInjector, s *seriesFaults, md *schema.MetricData) bool {
+		md.Mtype = "invalid Mtype"
+		md.SetId()
+		return true
+	}},
+	{"invalid-tags", true, func(f *faultInjector, s *seriesFaults, md *schema.MetricData) bool {
+		// don't append to the tags of the series, which are shared by all its points
+		md.Tags = append(md.Tags[:len(md.Tags):len(md.Tags)], "==invalid tags,#4561==")
+		md.SetId()
+		return true
+	}},
+	{"out-of-order", false, func(f *faultInjector, s *seriesFaults, md *schema.MetricData) bool {
+		ts := s.last - int64(f.outOfOrderBy*md.Interval)
+		if s.last == 0 || ts <= 0 {
+			return false
+		}
+		md.Time = ts
+		return true
+	}},
+	{"duplicate", false, func(f *faultInjector, s *seriesFaults, md *schema.MetricData) bool {
+		if s.last == 0 {
+			return false
+		}
+		md.Time = s.last
+		return true
+	}},
+	{"far-future", false, func(f *faultInjector, s *seriesFaults, md *schema.MetricData) bool {
+		md.Time += int64(f.farFutureBy.Seconds())
+		return true
+	}},
+	{"too-old", false, func(f *faultInjector, s *seriesFaults, md *schema.MetricData) bool {
+		ts := md.Time - int64(f.tooOldBy.Seconds())
+		if ts <= 0 {
+			return false
+		}
+		md.Time = ts
+		return true
+	}},
+	{"long-name", true, func(f *faultInjector, s *seriesFaults, md *schema.MetricData) bool {
+		md.Name += "." + f.long
+		md.SetId()
+		return true
+	}},
+	{"long-tag-value", true, func(f *faultInjector, s *seriesFaults, md *schema.MetricData) bool {
+		md.Tags = append(md.Tags[:len(md.Tags):len(md.Tags)], "long="+f.long)
+		md.SetId()
+		return true
+	}},
+	{"unicode-name", true, func(f *faultInjector, s *seriesFaults, md *schema.MetricData) bool {
+		md.Name += ".\x00\x01\t\n\x1b\x7f.ünïcødé-指标-\U0001F4C8"
+		md.SetId()
+		return true
+	}},
+	{"huge-tag-count", true, func(f *faultInjector, s *seriesFaults, md *schema.MetricData) bool {
+		md.Tags = append(md.Tags[:len(md.Tags):len(md.Tags)], f.tags...)
+		md.SetId()
+		return true
+	}},
+	{"id-mismatch", true, func(f *faultInjector, s *seriesFaults, md *schema.MetricData) bool {
+		// keep the id of the series, which is not the id of the new name
+		md.Name += ".mismatch"
+		return true
+	}},
+	{"conflicting-interval", true, func(f *faultInjector, s *seriesFaults, md *schema.MetricData) bool {
+		md.Interval *= 2
+		md.SetId()
+		return true
+	}},
+	{malformedMsgp, false, func(f *faultInjector, s *seriesFaults, md *schema.MetricData) bool {
+		if !f.rawOuts {
+			return false
+		}
+		f.raw = append(f.raw, f.malform(md))
+		return true
+	}},
+}
+
+// malformedMsgp is the kind of invalid data that is not sent as a metric, but as a raw payload
+const malformedMsgp = "malformed-msgp"
+
+// seriesFaults is the state of the faults of a series
+type seriesFaults struct {
+	gapLeft int   // how many more points to skip for the current gap
+	last    int64 // timestamp of the last valid point sent. 0 if none
+}
+
+// faultInjector injects data quality faults into the points of a feed.
+// a nil *faultInjector injects nothing.
+type faultInjector struct {
+	drop      float64
+	gap       float64
+	gapLength int
+	nan       float64
+	inf       float64
+	overflow  float64
+	// probability of each of the invalidClasses, and how many points out-of-order points go back
+	invalid      []float64
+	invalidTotal float64
+	outOfOrderBy int
+	farFutureBy  time.Duration
+	tooOldBy     time.Duration
+	long         string   // for long names and tag values
+	tags         []string // for huge tag counts
+
+	rng     *rand.Rand
+	series  [][]seriesFaults // per org and series, if any fault needs it
+	rawOuts bool             // whether any output can send raw payloads
+	raw     [][]byte         // raw payloads to send with the next flush
+}
+
+// newFaultInjector creates a faultInjector from a spec such as 'drop=0.01,nan=0.001', or returns nil if the spec is empty
+func newFaultInjector(spec string, rng *rand.Rand) (*faultInjector, error) {
+	if spec == "" {
+		return nil, nil
+	}
+	params, err := parseParams(spec)
+	if err != nil {
+		return nil, fmt.Errorf("faults: %s", err)
+	}
+	f := &faultInjector{rng: rng, invalid: make([]float64, len(invalidClasses))}
+	probability := func(key string) (float64, error) {
+		v, err := params.float(key, 0)
+		if err == nil && (v < 0 || v > 1) {
+			err = fmt.Errorf("param %q must be a probability between 0 and 1", key)
+		}
+		return v, err
+	}
+	for _, p := range []struct {
+		key string
+		val *float64
+	}{
+		{"drop", &f.drop},
+		{"gap", &f.gap},
+		{"nan", &f.nan},
+		{"inf", &f.inf},
+		{"float32-overflow", &f.overflow},
+	} {
+		if *p.val, err = probability(p.key); err != nil {
+			return nil, fmt.Errorf("faults: %s", err)
+		}
+	}
+	for i, c := range invalidClasses {
+		if f.invalid[i], err = probability(c.key); err != nil {
+			return nil, fmt.Errorf("faults: %s", err)
+		}
+		f.invalidTotal += f.invalid[i]
+	}
+	wholeNumber := func(key string, def float64) (int, error) {
+		v, err := params.float(key, def)
+		if err == nil && (v < 1 || v != math.Trunc(v)) {
+			err = fmt.Errorf("param %q must be a whole number >= 1", key)
+		}
+		return int(v), err
+	}
+	if f.gapLength, err = wholeNumber("gap-length", 10); err != nil {
+		return nil, fmt.Errorf("faults: %s", err)
+	}
+	if f.outOfOrderBy, err = wholeNumber("out-of-order-by", 5); err != nil {
+		return nil, fmt.Errorf("faults: %s", err)
+	}
+	longLength, err := wholeNumber("long-length", 65536)
+	if err != nil {
+		return nil, fmt.Errorf("faults: %s", err)
+	}
+	f.long = strings.Repeat("x", longLength)
+	tagCount, err := wholeNumber("tag-count", 1000)
+	if err != nil {
+		return nil, fmt.Errorf("faults: %s", err)
+	}
+	for i := 0; i < tagCount; i++ {
+		f.tags = append(f.tags, fmt.Sprintf("tag%d=value%d", i, i))
+	}
+	if f.farFutureBy, err = params.duration("far-future-by", 365*24*time.Hour); err != nil {
+		return nil, fmt.Errorf("faults: %s", err)
+	}
+	if f.tooOldBy, err = params.duration("too-old-by", 10*365*24*time.Hour); err != nil {
+		return nil, fmt.Errorf("faults: %s", err)
+	}
+	if f.nan+f.inf+f.overflow > 1 {
+		return nil, fmt.Errorf("faults: the probabilities of nan, inf and float32-overflow must not add up to more than 1")
+	}
+	if f.invalidTotal > 1+1e-9 {
+		return nil, fmt.Errorf("faults: the probabilities of the kinds of invalid data must not add up to more than 1")
+	}
+	if err := params.unknown(); err != nil {
+		return nil, fmt.Errorf("faults: %s", err)
+	}
+	return f, nil
+}
+
+func (f *faultInjector) Info() string {
+	if f == nil {
+		return "none"
+	}
+	var parts []string
+	for _, p := range []struct {
+		key string
+		val float64
+	}{
+		{"drop", f.drop},
+		{"gap", f.gap},
+		{"nan", f.nan},
+		{"inf", f.inf},
+		{"float32-overflow", f.overflow},
+	} {
+		if p.val > 0 {
+			parts = append(parts, fmt.Sprintf("%s=%g", p.key, p.val))
+		}
+	}
+	if f.gap > 0 {
+		parts = append(parts, fmt.Sprintf("gap-length=%d", f.gapLength))
+	}
+	for i, c := range invalidClasses {
+		if f.invalid[i] > 0 {
+			parts = append(parts, fmt.Sprintf("%s=%g", c.key, f.invalid[i]))
+			switch c.key {
+			case "out-of-order":
+				parts = append(parts, fmt.Sprintf("out-of-order-by=%d", f.outOfOrderBy))
+			case "far-future":
+				parts = append(parts, fmt.Sprintf("far-future-by=%s", f.farFutureBy))
+			case "too-old":
+				parts = append(parts, fmt.Sprintf("too-old-by=%s", f.tooOldBy))
+			case "long-name", "long-tag-value":
+				parts = append(parts, fmt.Sprintf("long-length=%d", len(f.long)))
+			case "huge-tag-count":
+				parts = append(parts, fmt.Sprintf("tag-count=%d", len(f.tags)))
+			}
+		}
+	}
+	if len(parts) == 0 {
+		return "none"
+	}
+	return strings.Join(parts, ",")
+}
+
+// seriesState returns the fault state of series m of org o
+func (f *faultInjector) seriesState(o, m int) *seriesFaults {
+	for len(f.series) <= o {
+		f.series = append(f.series, nil)
+	}
+	for len(f.series[o]) <= m {
+		f.series[o] = append(f.series[o], seriesFaults{})
+	}
+	return &f.series[o][m]
+}
+
+// apply injects faults into the point of series m of org o.
+// it returns whether the point must be sent, and if so, whether it must be sent as full MetricData.
+func (f *faultInjector) apply(o, m int, md *schema.MetricData) (send, full bool) {
+	if f == nil {
+		return true, false
+	}
+	var s *seriesFaults
+	if f.gap > 0 || f.invalidTotal > 0 {
+		s = f.seriesState(o, m)
+	}
+	if f.gap > 0 {
+		if s.gapLeft > 0 {
+			s.gapLeft--
+			faultStats.gapPoints.Inc(1)
+			return false, false
+		}
+		if f.rng.Float64() < f.gap {
+			s.gapLeft = f.gapLength - 1
+			faultStats.gaps.Inc(1)
+			faultStats.gapPoints.Inc(1)
+			return false, false
+		}
+	}
+	if f.drop > 0 && f.rng.Float64() < f.drop {
+		faultStats.dropped.Inc(1)
+		return false, false
+	}
+	if f.invalidTotal > 0 {
+		r := f.rng.Float64()
+		for i, c := range invalidClasses {
+			if r -= f.invalid[i]; r >= 0 {
+				continue
+			}
+			// the point is only invalid if the class applies to it, otherwise it remains valid
+			if c.apply(f, s, md) {
+				faultStats.invalid[c.key].Inc(1)
+				return c.key != malformedMsgp, c.full
+			}
+			break
+		}
+	}
+	f.applyValue(md)
+	if s != nil {
+		s.last = md.Time
+	}
+	return true, false
+}
+
+// applyValue injects a NaN, infinite or overflowing value into the point
+func (f *faultInjector) applyValue(md *schema.MetricData) {
+	if f.nan+f.inf+f.overflow == 0 {
+		return
+	}
+	sign := 1.0
+	if f.rng.Intn(2) == 0 {
+		sign = -1
+	}
+	switch r := f.rng.Float64(); {
+	case r < f.nan:
+		md.Value = math.NaN()
+		faultStats.nan.Inc(1)
+	case r < f.nan+f.inf:
+		md.Value = math.Inf(int(sign))
+		faultStats.inf.Inc(1)
+	case r < f.nan+f.inf+f.overflow:
+		// beyond the max float32, by up to a factor 1000
+		md.Value = sign * math.MaxFloat32 * math.Pow(1000, f.rng.Float64()) * 1.001
+		faultStats.overflow.Inc(1)
+	}
+}
+
+// malform returns a corrupt msgp encoding of the point: either truncated,
+// or starting with 0xc1, which msgp never uses
+func (f *faultInjector) malform(md *schema.MetricData) []byte {
+	data, err := md.MarshalMsg(nil)
+	if err != nil || len(data) < 2 {
+		return []byte{0xc1}
+	}
+	if f.rng.Intn(2) == 0 {
+		return data[:1+f.rng.Intn(len(data)-1)]
+	}
+	data[0] = 0xc1
+	return data
+}
+
+// useOutputs checks whether the outputs can send all the faults
+func (f *faultInjector) useOutputs(outs []out.Out) error {
+	if f == nil {
+		return nil
+	}
+	for _, o := range outs {
+		if _, ok := o.(out.RawOut); ok {
+			f.rawOuts = true
+		}
+	}
+	for i, c := range invalidClasses {
+		if c.key == malformedMsgp && f.invalid[i] > 0 && !f.rawOuts {
+			return fmt.Errorf("faults: %s requires a kafka output", malformedMsgp)
+		}
+	}
+	return nil
+}
+
+// flushFull sends the points that must be sent as full MetricData
+func (f *faultInjector) flushFull(outs []out.Out, full []*schema.MetricData) {
+	if len(full) == 0 {
+		return
+	}
+	for _, o := range outs {
+		if err := out.FlushFull(o, full); err != nil {
+			log.Error(0, err.Error())
+		}
+	}
+}
+
+// flushRaw sends the pending raw payloads to the outputs that can send them
+func (f *faultInjector) flushRaw(outs []out.Out) {
+	if f == nil || len(f.raw) == 0 {
+		return
+	}
+	for _, o := range outs {
+		if ro, ok := o.(out.RawOut); ok {
+			if err := ro.FlushRaw(f.raw); err != nil {
+				log.Error(0, err.Error())
+			}
+		}
+	}
+	f.raw = f.raw[:0]
+}
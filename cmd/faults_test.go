@@ -0,0 +1,213 @@
+package cmd
+
+import (
+	"math"
+	"math/rand"
+	"strings"
+	"testing"
+
+	"github.com/grafana/metrictank/schema"
+	"github.com/raintank/fakemetrics/out"
+	"github.com/raintank/fakemetrics/promstats"
+)
+
+func TestNewFaultInjector(t *testing.T) {
+	cases := []struct {
+		spec    string
+		expInfo string
+		expErr  bool
+	}{
+		{"", "none", false},
+		{"drop=0.01,nan=0.001", "drop=0.01,nan=0.001", false},
+		{"gap=0.1", "gap=0.1,gap-length=10", false},
+		{"drop=1.5", "", true},
+		{"gap=0.1,gap-length=2.5", "", true},
+		{"nan=0.5,inf=0.6", "", true},
+		{"drop", "", true},
+		{"foo=1", "", true},
+		{"invalid-orgid=0.1,out-of-order=0.2", "invalid-orgid=0.1,out-of-order=0.2,out-of-order-by=5", false},
+		{"invalid-name=0.6,duplicate=0.6", "", true},
+		{"out-of-order=0.1,out-of-order-by=0", "", true},
+		{"far-future=0.1,huge-tag-count=0.1,tag-count=10", "far-future=0.1,far-future-by=8760h0m0s,huge-tag-count=0.1,tag-count=10", false},
+		{"too-old=0.1,too-old-by=-1h", "", true},
+	}
+	for _, c := range cases {
+		f, err := newFaultInjector(c.spec, rand.New(rand.NewSource(1)))
+		if c.expErr {
+			if err == nil {
+				t.Errorf("spec %q: expected error, got none", c.spec)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("spec %q: expected no error, got %s", c.spec, err)
+			continue
+		}
+		if f.Info() != c.expInfo {
+			t.Errorf("spec %q: expected info %q, got %q", c.spec, c.expInfo, f.Info())
+		}
+	}
+}
+
+// applyFaults applies the faults to n points of 1 series, and returns the points that are kept
+func applyFaults(t *testing.T, spec string, n int) []schema.MetricData {
+	f, err := newFaultInjector(spec, rand.New(rand.NewSource(1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var kept []schema.MetricData
+	for i := 0; i < n; i++ {
+		md := schema.MetricData{Value: 1}
+		if send, _ := f.apply(0, 0, &md); send {
+			kept = append(kept, md)
+		}
+	}
+	return kept
+}
+
+func TestFaultInjector(t *testing.T) {
+	r := newRecorder(promstats.New())
+	faultStats = newFaultCounters(r)
+
+	// a gap always starts right after the previous one
+	if kept := applyFaults(t, "gap=1,gap-length=3", 9); len(kept) != 0 {
+		t.Fatalf("expected all points to be in gaps, got %d kept", len(kept))
+	}
+	if gaps, points := r.count("metricpublisher.global.faults_gaps"), r.count("metricpublisher.global.faults_gap_points"); gaps != 3 || points != 9 {
+		t.Fatalf("expected 3 gaps of 9 points in total, got %d gaps of %d points", gaps, points)
+	}
+
+	kept := applyFaults(t, "drop=0.1", 10000)
+	if dropped := r.count("metricpublisher.global.faults_dropped"); dropped < 800 || dropped > 1200 || int(dropped)+len(kept) != 10000 {
+		t.Fatalf("expected about 1000 of 10000 points dropped, got %d dropped and %d kept", dropped, len(kept))
+	}
+
+	for _, md := range applyFaults(t, "nan=1", 10) {
+		if !math.IsNaN(md.Value) {
+			t.Fatalf("expected NaN, got %f", md.Value)
+		}
+	}
+	for _, md := range applyFaults(t, "float32-overflow=1", 10) {
+		if math.IsInf(md.Value, 0) || math.Abs(md.Value) <= math.MaxFloat32 {
+			t.Fatalf("expected a finite value beyond the float32 range, got %g", md.Value)
+		}
+	}
+	if nan, overflow := r.count("metricpublisher.global.faults_nan"), r.count("metricpublisher.global.faults_float32_overflow"); nan != 10 || overflow != 10 {
+		t.Fatalf("expected 10 NaN and 10 float32 overflows, got %d and %d", nan, overflow)
+	}
+}
+
+func TestFaultInjectorInvalid(t *testing.T) {
+	r := newRecorder(promstats.New())
+	faultStats = newFaultCounters(r)
+
+	f, err := newFaultInjector("invalid-orgid=0.1,invalid-tags=0.1,out-of-order=0.1,out-of-order-by=2,duplicate=0.1", rand.New(rand.NewSource(1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tags := []string{"a=b"}
+	var last [2]int64
+	var valid, orgid, badTags, ooo, dup int64
+	for ts := int64(1); ts <= 1000; ts++ {
+		for m := 0; m < 2; m++ {
+			md := schema.MetricData{OrgId: 1, Interval: 1, Time: ts, Tags: tags}
+			if send, _ := f.apply(0, m, &md); !send {
+				t.Fatalf("expected all points to be sent")
+			}
+			switch {
+			case md.OrgId == 0:
+				orgid++
+			case len(md.Tags) == 2:
+				badTags++
+			case md.Time == last[m]:
+				dup++
+			case md.Time == last[m]-2:
+				ooo++
+			case md.Time == ts:
+				valid++
+				last[m] = ts
+			default:
+				t.Fatalf("series %d: unexpected point %v after %d", m, md, last[m])
+			}
+		}
+	}
+	if len(tags) != 1 || tags[0] != "a=b" {
+		t.Fatalf("expected the tags of the series to be unchanged, got %v", tags)
+	}
+	counts := map[string]int64{"invalid-orgid": orgid, "invalid-tags": badTags, "out-of-order": ooo, "duplicate": dup}
+	for key, exp := range counts {
+		if got := r.count("metricpublisher.global.faults_" + strings.Replace(key, "-", "_", -1)); got != exp || got < 120 || got > 280 {
+			t.Errorf("expected about 200 points with %s, and the stat to match the %d seen, got %d", key, exp, got)
+		}
+	}
+	if valid+orgid+badTags+ooo+dup != 2000 {
+		t.Fatalf("expected 2000 points, got %d", valid+orgid+badTags+ooo+dup)
+	}
+}
+
+// rawOut is an output that records the raw payloads
+type rawOut struct {
+	payloads [][]byte
+}
+
+func (r *rawOut) Close() error                             { return nil }
+func (r *rawOut) Flush(metrics []*schema.MetricData) error { return nil }
+func (r *rawOut) FlushRaw(payloads [][]byte) error {
+	r.payloads = append(r.payloads, payloads...)
+	return nil
+}
+
+func TestFaultInjectorInvalidKinds(t *testing.T) {
+	r := newRecorder(promstats.New())
+	faultStats = newFaultCounters(r)
+
+	const id = "1.0123456789abcdef0123456789abcdef"
+	cases := []struct {
+		spec    string
+		expFull bool // whether the point must be sent as full MetricData
+		check   func(md schema.MetricData) bool
+	}{
+		{"far-future=1", false, func(md schema.MetricData) bool { return md.Time == 1500000000+365*24*3600 }},
+		{"too-old=1,too-old-by=24h", false, func(md schema.MetricData) bool { return md.Time == 1500000000-24*3600 }},
+		{"long-name=1,long-length=1000", true, func(md schema.MetricData) bool { return len(md.Name) == len("a.b")+1+1000 }},
+		{"long-tag-value=1,long-length=10", true, func(md schema.MetricData) bool { return len(md.Tags) == 2 && md.Tags[1] == "long=xxxxxxxxxx" }},
+		{"unicode-name=1", true, func(md schema.MetricData) bool { return strings.ContainsAny(md.Name, "\x00\n") }},
+		{"huge-tag-count=1,tag-count=500", true, func(md schema.MetricData) bool { return len(md.Tags) == 501 }},
+		{"id-mismatch=1", true, func(md schema.MetricData) bool { return md.Name == "a.b.mismatch" && md.Id == id }},
+		{"conflicting-interval=1", true, func(md schema.MetricData) bool { return md.Name == "a.b" && md.Interval == 20 }},
+	}
+	for _, c := range cases {
+		f, err := newFaultInjector(c.spec, rand.New(rand.NewSource(1)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		md := schema.MetricData{Id: id, OrgId: 1, Name: "a.b", Interval: 10, Time: 1500000000, Tags: []string{"a=b"}}
+		send, full := f.apply(0, 0, &md)
+		if !send || full != c.expFull || !c.check(md) {
+			t.Errorf("spec %q: unexpected point %v, with full %t", c.spec, md, full)
+		}
+	}
+
+	f, err := newFaultInjector("malformed-msgp=0.5", rand.New(rand.NewSource(1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.useOutputs(nil); err == nil {
+		t.Fatal("expected error for malformed msgp without an output that can send it")
+	}
+	raw := &rawOut{}
+	if err := f.useOutputs([]out.Out{raw}); err != nil {
+		t.Fatal(err)
+	}
+	var sent int
+	for i := 0; i < 100; i++ {
+		md := schema.MetricData{OrgId: 1, Name: "a.b", Interval: 10, Time: 1500000000}
+		if send, _ := f.apply(0, 0, &md); send {
+			sent++
+		}
+	}
+	f.flushRaw([]out.Out{raw})
+	if malformed := r.count("metricpublisher.global.faults_malformed_msgp"); sent+len(raw.payloads) != 100 || int64(len(raw.payloads)) != malformed {
+		t.Fatalf("expected the %d malformed points not to be sent but as %d raw payloads, and the %d others to be sent", malformed, len(raw.payloads), sent)
+	}
+}
@@ -17,6 +17,7 @@ package cmd
 import (
 	"time"
 
+	"github.com/raintank/worldping-api/pkg/log"
 	"github.com/spf13/cobra"
 )
 
@@ -27,8 +28,42 @@ var feedCmd = &cobra.Command{
 		initStats(true, "feed")
 		period = int(periodDur.Seconds())
 		flush = int(flushDur.Nanoseconds() / 1000 / 1000)
+		vg, err := NewValueGenerator(valueModel, newRand())
+		if err != nil {
+			log.Fatal(4, "%s", err)
+		}
+		tb, err := newTaggedBuilder()
+		if err != nil {
+			log.Fatal(4, "%s", err)
+		}
+		profile, err := NewLoadProfile(loadProfile)
+		if err != nil {
+			log.Fatal(4, "%s", err)
+		}
+		churn, err := newChurner(churnPct, churnInterval)
+		if err != nil {
+			log.Fatal(4, "%s", err)
+		}
+		dist, err := NewIntervalDistribution(intervalDistribution, newRand().Int63())
+		if err != nil {
+			log.Fatal(4, "%s", err)
+		}
+		faults, err := newFaultInjector(faultSpec, newRand())
+		if err != nil {
+			log.Fatal(4, "%s", err)
+		}
+		lim := newRunLimit(runDuration, maxPoints)
+		lim.stopOnSignal()
 		outs := getOutputs()
-		dataFeed(outs, orgs, mpo, period, flush, 0, 1, false, TaggedBuilder{metricName})
+		err = dataFeed("feed", outs, orgs, mpo, period, flush, tb, vg, feedOptions{maxLag: maxLag, profile: profile, churn: churn, dist: &dist, faults: faults}, lim)
+		if err != nil {
+			lim.stop(err.Error())
+		}
+		closeOutputs(outs)
+		finishRun(lim)
+		if err != nil {
+			log.Fatal(4, "%s", err)
+		}
 
 	},
 }
@@ -36,8 +71,17 @@ var feedCmd = &cobra.Command{
 func init() {
 	rootCmd.AddCommand(feedCmd)
 	feedCmd.Flags().StringVar(&metricName, "metricname", "some.id.of.a.metric", "the metric name to use")
+	feedCmd.Flags().StringVar(&valueModel, "value-model", "random", valueModelHelp)
+	feedCmd.Flags().StringVar(&loadProfile, "load-profile", "flat", loadProfileHelp)
+	feedCmd.Flags().StringVar(&intervalDistribution, "interval-distribution", "fixed", intervalDistributionHelp)
+	feedCmd.Flags().StringVar(&faultSpec, "faults", "", faultsHelp)
 	feedCmd.Flags().IntVar(&orgs, "orgs", 1, "how many orgs to simulate")
 	feedCmd.Flags().IntVar(&mpo, "mpo", 100, "how many metrics per org to simulate")
 	feedCmd.Flags().DurationVar(&flushDur, "flush", time.Second, "how often to flush metrics")
 	feedCmd.Flags().DurationVar(&periodDur, "period", time.Second, "period between metric points (must be a multiple of 1s)")
+	feedCmd.Flags().DurationVar(&runDuration, "duration", 0, "how long to run for. 0 to run until interrupted")
+	feedCmd.Flags().Int64Var(&maxPoints, "max-points", 0, "stop after sending this many points. 0 for no limit")
+	feedCmd.Flags().Float64Var(&churnPct, "churn-pct", 10, "percentage of the series of each org to replace by new series, every churn interval")
+	feedCmd.Flags().DurationVar(&churnInterval, "churn-interval", 0, "how often to replace series (in data time, must be a multiple of 1s). the replaced series stop sending, so they go stale. 0 to disable churn")
+	feedCmd.Flags().DurationVar(&maxLag, "max-lag", 0, "fail when falling further behind schedule than this, because flushing can't keep up. 0 to never fail")
 }
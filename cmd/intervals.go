@@ -0,0 +1,201 @@
+package cmd
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/grafana/metrictank/schema"
+)
+
+const intervalDistributionHelp = "how often each series gets a point. one of fixed|mix|zipf, optionally followed by ':' and comma separated key=value params. " +
+	"'fixed' gives all series the period as interval. 'mix:1s=10,10s=60,60s=30' gives 10% of the series an interval of 1s, 60% 10s and 30% 60s. " +
+	"'zipf:s=1,max=10m' gives the series of rank r (in random order) an interval of r^s periods, up to max, so that a few series get most of the writes. " +
+	"intervals must be multiples of the period. series with a longer interval than the period skip their turn, so they lower the rate"
+
+// IntervalDistribution assigns an interval to each series of a feed
+type IntervalDistribution struct {
+	kind string
+	// for mix: the intervals and their weights, sorted by interval
+	intervals []time.Duration
+	weights   []float64
+	// for zipf
+	exponent float64
+	max      time.Duration
+	// seed for assigning the intervals. every assignment with the same seed gives the same intervals
+	seed int64
+}
+
+func (d IntervalDistribution) Info() string {
+	switch d.kind {
+	case "mix":
+		parts := make([]string, len(d.intervals))
+		for i, interval := range d.intervals {
+			parts[i] = fmt.Sprintf("%s=%g", interval, d.weights[i])
+		}
+		return "mix:" + strings.Join(parts, ",")
+	case "zipf":
+		return fmt.Sprintf("zipf:s=%g,max=%s", d.exponent, d.max)
+	}
+	return "fixed"
+}
+
+// NewIntervalDistribution creates an IntervalDistribution from a spec such as 'mix:1s=10,10s=60,60s=30'
+func NewIntervalDistribution(spec string, seed int64) (IntervalDistribution, error) {
+	kind, params, err := parseSpec(spec)
+	if err != nil {
+		return IntervalDistribution{}, fmt.Errorf("interval distribution %q: %s", kind, err)
+	}
+	d := IntervalDistribution{kind: kind, seed: seed}
+	switch kind {
+	case "", "fixed":
+		d.kind = "fixed"
+	case "mix":
+		if len(params) == 0 {
+			return d, fmt.Errorf("interval distribution %q: needs at least one interval=weight param", kind)
+		}
+		weights := make(map[time.Duration]float64)
+		var total float64
+		for key := range params {
+			interval, err := time.ParseDuration(key)
+			if err != nil || interval < time.Second || interval%time.Second != 0 {
+				return d, fmt.Errorf("interval distribution %q: interval %q must be a multiple of 1s", kind, key)
+			}
+			if _, ok := weights[interval]; ok {
+				return d, fmt.Errorf("interval distribution %q: duplicate interval %s", kind, interval)
+			}
+			w, err := params.float(key, 0)
+			if err == nil && w < 0 {
+				err = fmt.Errorf("weight of %q must not be negative", key)
+			}
+			if err != nil {
+				return d, fmt.Errorf("interval distribution %q: %s", kind, err)
+			}
+			weights[interval] = w
+			total += w
+			d.intervals = append(d.intervals, interval)
+		}
+		if total == 0 {
+			return d, fmt.Errorf("interval distribution %q: weights must not all be 0", kind)
+		}
+		sort.Slice(d.intervals, func(i, j int) bool { return d.intervals[i] < d.intervals[j] })
+		for _, interval := range d.intervals {
+			d.weights = append(d.weights, weights[interval])
+		}
+	case "zipf":
+		if d.exponent, err = params.float("s", 1); err != nil {
+			break
+		}
+		if d.exponent <= 0 {
+			err = fmt.Errorf("param %q must be > 0", "s")
+			break
+		}
+		if d.max, err = params.duration("max", 10*time.Minute); err != nil {
+			break
+		}
+		if d.max%time.Second != 0 {
+			err = fmt.Errorf("param %q must be a multiple of 1s", "max")
+		}
+	default:
+		return d, fmt.Errorf("unknown interval distribution %q", kind)
+	}
+	if err != nil {
+		return d, fmt.Errorf("interval distribution %q: %s", kind, err)
+	}
+	if err := params.unknown(); err != nil {
+		return d, fmt.Errorf("interval distribution %q: %s", kind, err)
+	}
+	return d, nil
+}
+
+// check validates the distribution against the period of the feed (in s)
+func (d IntervalDistribution) check(period int) error {
+	p := time.Duration(period) * time.Second
+	for _, interval := range d.intervals {
+		if interval%p != 0 {
+			return fmt.Errorf("interval distribution: interval %s is not a multiple of the period %s", interval, p)
+		}
+	}
+	if d.kind == "zipf" && d.max < p {
+		return fmt.Errorf("interval distribution: max %s is less than the period %s", d.max, p)
+	}
+	return nil
+}
+
+// assign returns the interval of each of the mpo series, as a multiple of the period (in s)
+func (d IntervalDistribution) assign(mpo, period int) []int {
+	mults := make([]int, mpo)
+	rng := rand.New(rand.NewSource(d.seed))
+	switch d.kind {
+	case "mix":
+		// give each interval its share of the series, distributing the rounding remainders
+		// by largest remainder, such that the shares are as exact as possible
+		var total float64
+		for _, w := range d.weights {
+			total += w
+		}
+		counts := make([]int, len(d.weights))
+		rems := make([]float64, len(d.weights))
+		assigned := 0
+		for i, w := range d.weights {
+			share := float64(mpo) * w / total
+			counts[i] = int(share)
+			rems[i] = share - float64(counts[i])
+			assigned += counts[i]
+		}
+		order := make([]int, len(d.weights))
+		for i := range order {
+			order[i] = i
+		}
+		sort.SliceStable(order, func(a, b int) bool { return rems[order[a]] > rems[order[b]] })
+		for i := 0; assigned < mpo; i++ {
+			counts[order[i]]++
+			assigned++
+		}
+		perm := rng.Perm(mpo)
+		j := 0
+		for i, c := range counts {
+			mult := int(d.intervals[i].Seconds()) / period
+			for ; c > 0; c-- {
+				mults[perm[j]] = mult
+				j++
+			}
+		}
+	case "zipf":
+		maxMult := int(d.max.Seconds()) / period
+		for rank, m := range rng.Perm(mpo) {
+			mult := int(math.Round(math.Pow(float64(rank+1), d.exponent)))
+			if mult > maxMult || mult < 1 {
+				mult = maxMult
+			}
+			mults[m] = mult
+		}
+	default:
+		for m := range mults {
+			mults[m] = 1
+		}
+	}
+	return mults
+}
+
+// density returns the average amount of points per series per period, given the multiples of the period
+func density(mults []int) float64 {
+	var sum float64
+	for _, mult := range mults {
+		sum += 1 / float64(mult)
+	}
+	return sum / float64(len(mults))
+}
+
+// setIntervals sets the interval of the series, given the multiples of the period
+func setIntervals(metrics [][]schema.MetricData, mults []int, period int) {
+	for o := range metrics {
+		for m := range metrics[o] {
+			metrics[o][m].Interval = mults[m] * period
+			metrics[o][m].SetId()
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package cmd
+
+import (
+	"math"
+	"testing"
+)
+
+func TestNewIntervalDistribution(t *testing.T) {
+	cases := []struct {
+		spec    string
+		expInfo string
+		expErr  bool
+	}{
+		{"fixed", "fixed", false},
+		{"mix:60s=30,1s=10,10s=60", "mix:1s=10,10s=60,1m0s=30", false},
+		{"zipf", "zipf:s=1,max=10m0s", false},
+		{"zipf:s=1.5,max=1h", "zipf:s=1.5,max=1h0m0s", false},
+		{"mix", "", true},
+		{"mix:1s=0", "", true},
+		{"mix:1500ms=1", "", true},
+		{"mix:1m=1,60s=2", "", true},
+		{"mix:1s=-1,10s=2", "", true},
+		{"zipf:s=0", "", true},
+		{"zipf:foo=bar", "", true},
+		{"bogus", "", true},
+	}
+	for _, c := range cases {
+		d, err := NewIntervalDistribution(c.spec, 1)
+		if c.expErr {
+			if err == nil {
+				t.Errorf("spec %q: expected error, got none", c.spec)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("spec %q: expected no error, got %s", c.spec, err)
+			continue
+		}
+		if d.Info() != c.expInfo {
+			t.Errorf("spec %q: expected info %q, got %q", c.spec, c.expInfo, d.Info())
+		}
+	}
+}
+
+func TestIntervalDistributionAssign(t *testing.T) {
+	d, err := NewIntervalDistribution("mix:1s=10,10s=60,60s=30", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.check(1); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.check(20); err == nil {
+		t.Fatal("expected error for intervals that are not a multiple of the period")
+	}
+	counts := make(map[int]int)
+	for _, mult := range d.assign(1000, 1) {
+		counts[mult]++
+	}
+	if counts[1] != 100 || counts[10] != 600 || counts[60] != 300 {
+		t.Fatalf("expected 100, 600 and 300 series with an interval of 1, 10 and 60s, got %v", counts)
+	}
+
+	// shares that don't divide evenly are rounded by largest remainder
+	counts = make(map[int]int)
+	for _, mult := range d.assign(7, 1) {
+		counts[mult]++
+	}
+	if counts[1] != 1 || counts[10] != 4 || counts[60] != 2 {
+		t.Fatalf("expected 1, 4 and 2 series with an interval of 1, 10 and 60s, got %v", counts)
+	}
+
+	d, err = NewIntervalDistribution("zipf:s=1,max=5s", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	counts = make(map[int]int)
+	for _, mult := range d.assign(10, 1) {
+		counts[mult]++
+	}
+	if counts[1] != 1 || counts[2] != 1 || counts[5] != 6 {
+		t.Fatalf("expected the series of rank 1, 2 and >=5 to have an interval of 1, 2 and 5s, got %v", counts)
+	}
+	if exp := (1 + 1.0/2 + 1.0/3 + 1.0/4 + 6.0/5) / 10; math.Abs(density(d.assign(10, 1))-exp) > 1e-9 {
+		t.Fatalf("expected density %f, got %f", exp, density(d.assign(10, 1)))
+	}
+}
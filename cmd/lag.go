@@ -0,0 +1,92 @@
+// Copyright © 2018 Grafana Labs
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"time"
+
+	"github.com/raintank/worldping-api/pkg/log"
+)
+
+// lagWarnInterval is how often we warn at most, while we keep falling behind
+const lagWarnInterval = 10 * time.Second
+
+// lagTracker detects when a feed falls behind schedule.
+// a time.Ticker drops ticks when the receiver is too slow, and every dropped tick
+// means a flush worth of points that never gets generated. but the generated timestamps
+// can also drift from the clock for other reasons, so the lag is measured on the data:
+// how far the wall clock is ahead of the time that the data generated so far corresponds to.
+// for realtime feeds, that is how far the last generated timestamp is behind the clock.
+// for backfills, the data time is scaled back by the speedup and corrected for the offset.
+type lagTracker struct {
+	name       string // to identify the feed in warnings
+	begin      time.Time
+	start      time.Time // data time at begin
+	speedup    int
+	interval   time.Duration
+	ticks      int64
+	lag        time.Duration // as last reported
+	missed     int64         // as last reported
+	warnedAt   time.Time
+	warnedMiss int64 // missed ticks as of the last warning
+	warnedLag  time.Duration
+}
+
+func newLagTracker(name string, begin, start time.Time, speedup int, interval time.Duration) *lagTracker {
+	return &lagTracker{
+		name:     name,
+		begin:    begin,
+		start:    start,
+		speedup:  speedup,
+		interval: interval,
+	}
+}
+
+// tick registers that a tick has been processed completely at the given time,
+// having generated the data up to the given data time, and returns the current lag
+func (l *lagTracker) tick(now, generated time.Time) time.Duration {
+	l.ticks++
+	missed := int64((now.Sub(l.begin) - time.Duration(l.ticks)*l.interval) / l.interval)
+	if missed < 0 {
+		missed = 0
+	}
+	lag := now.Sub(l.begin) - generated.Sub(l.start)/time.Duration(l.speedup)
+	if lag < -l.interval && now.Sub(l.warnedAt) >= lagWarnInterval {
+		log.Warn("%s is generating data %s ahead of schedule", l.name, -lag)
+		l.warnedAt = now
+	}
+	if lag < 0 {
+		lag = 0
+	}
+
+	// several feeds may run concurrently, so we adjust the gauges by our change,
+	// such that they show the sum over all feeds.
+	lagMs.Inc(int64(lag/time.Millisecond) - int64(l.lag/time.Millisecond))
+	missedTicks.Inc(missed - l.missed)
+	l.lag, l.missed = lag, missed
+
+	if (missed > l.warnedMiss || lag > l.warnedLag+l.interval) && lag > l.interval && now.Sub(l.warnedAt) >= lagWarnInterval {
+		log.Warn("%s can't keep up: missed %d ticks so far and lagging %s behind schedule. the actual rate is lower than requested", l.name, missed, lag)
+		l.warnedAt, l.warnedMiss, l.warnedLag = now, missed, lag
+	}
+	return lag
+}
+
+// done removes our contribution from the gauges, once the feed has ended
+func (l *lagTracker) done() {
+	lagMs.Dec(int64(l.lag / time.Millisecond))
+	missedTicks.Dec(l.missed)
+	l.lag, l.missed = 0, 0
+}
@@ -0,0 +1,58 @@
+package cmd
+
+import (
+	"testing"
+	"time"
+
+	"github.com/raintank/fakemetrics/promstats"
+)
+
+func TestLagTracker(t *testing.T) {
+	r := newRecorder(promstats.New())
+	lagMs = r.NewGauge("metricpublisher.global.lag_ms", 0)
+	missedTicks = r.NewGauge("metricpublisher.global.missed_ticks", 0)
+
+	begin := time.Unix(1000, 0)
+	l1 := newLagTracker("a", begin, begin, 1, 100*time.Millisecond)
+	// a backfill 1h back, at 10x speed
+	l2 := newLagTracker("b", begin, begin.Add(-time.Hour), 10, time.Second)
+
+	if lag := l1.tick(begin.Add(105*time.Millisecond), begin.Add(100*time.Millisecond)); lag != 5*time.Millisecond {
+		t.Fatalf("expected lag of 5ms, got %s", lag)
+	}
+	// the next tick took so long, that 2 ticks were dropped
+	if lag := l1.tick(begin.Add(450*time.Millisecond), begin.Add(200*time.Millisecond)); lag != 250*time.Millisecond {
+		t.Fatalf("expected lag of 250ms, got %s", lag)
+	}
+	// no ticks dropped, but the generated data fell behind the clock
+	if lag := l1.tick(begin.Add(500*time.Millisecond), begin.Add(150*time.Millisecond)); lag != 350*time.Millisecond {
+		t.Fatalf("expected lag of 350ms, got %s", lag)
+	}
+	// 3.5s in, the backfill should have generated 35s of data
+	if lag := l2.tick(begin.Add(3500*time.Millisecond), begin.Add(-time.Hour+10*time.Second)); lag != 2500*time.Millisecond {
+		t.Fatalf("expected lag of 2.5s, got %s", lag)
+	}
+
+	// the gauges are summed over both trackers
+	if got := r.gauge("metricpublisher.global.lag_ms"); got != 2850 {
+		t.Fatalf("expected lag gauge of 2850, got %d", got)
+	}
+	if got := r.gauge("metricpublisher.global.missed_ticks"); got != 4 {
+		t.Fatalf("expected missed ticks gauge of 4, got %d", got)
+	}
+
+	// data ahead of the clock is no lag
+	if lag := l2.tick(begin.Add(4*time.Second), begin.Add(-time.Hour+time.Minute)); lag != 0 {
+		t.Fatalf("expected no lag, got %s", lag)
+	}
+
+	// a feed that ended no longer counts
+	l1.done()
+	if lag, missed := r.gauge("metricpublisher.global.lag_ms"), r.gauge("metricpublisher.global.missed_ticks"); lag != 0 || missed != 2 {
+		t.Fatalf("expected only the 2 missed ticks of the remaining feed, got lag %d and %d missed ticks", lag, missed)
+	}
+	l2.done()
+	if lag, missed := r.gauge("metricpublisher.global.lag_ms"), r.gauge("metricpublisher.global.missed_ticks"); lag != 0 || missed != 0 {
+		t.Fatalf("expected the gauges to be 0 once all feeds are done, got lag %d and %d missed ticks", lag, missed)
+	}
+}
@@ -0,0 +1,115 @@
+// Copyright © 2018 Grafana Labs
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/raintank/worldping-api/pkg/log"
+)
+
+// runLimit bounds a run: it ends the run when it gets interrupted, when its duration has elapsed,
+// or when its max amount of points has been sent.
+// a nil *runLimit never ends.
+type runLimit struct {
+	maxPoints int64 // 0 means unlimited
+	points    int64 // sent so far, when limited. accessed atomically
+	done      chan struct{}
+	once      sync.Once
+	reason    string // why the run ended. only set via once
+}
+
+func newRunLimit(duration time.Duration, maxPoints int64) *runLimit {
+	l := &runLimit{
+		maxPoints: maxPoints,
+		done:      make(chan struct{}),
+	}
+	if duration > 0 {
+		time.AfterFunc(duration, func() { l.stop("duration elapsed") })
+	}
+	return l
+}
+
+// Done returns a channel that is closed when the run should end
+func (l *runLimit) Done() <-chan struct{} {
+	if l == nil {
+		return nil
+	}
+	return l.done
+}
+
+func (l *runLimit) stop(reason string) {
+	l.once.Do(func() {
+		l.reason = reason
+		close(l.done)
+	})
+}
+
+// stopOnSignal ends the run upon SIGINT or SIGTERM.
+// a second signal exits right away, without waiting for a graceful shutdown.
+func (l *runLimit) stopOnSignal() {
+	sigs := make(chan os.Signal, 2)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-sigs
+		log.Info("received %s. shutting down. send again to exit immediately", sig)
+		l.stop("received " + sig.String())
+		sig = <-sigs
+		log.Fatal(4, "received %s again. exiting immediately", sig)
+	}()
+}
+
+// take claims up to n points to send, and returns how many may be sent.
+// once the max amount of points is reached, the run is ended.
+func (l *runLimit) take(n int) int {
+	if l == nil || l.maxPoints == 0 {
+		return n
+	}
+	for {
+		cur := atomic.LoadInt64(&l.points)
+		allowed := l.maxPoints - cur
+		if allowed <= 0 {
+			l.stop("max points reached")
+			return 0
+		}
+		if allowed > int64(n) {
+			allowed = int64(n)
+		}
+		if atomic.CompareAndSwapInt64(&l.points, cur, cur+allowed) {
+			if cur+allowed == l.maxPoints {
+				l.stop("max points reached")
+			}
+			return int(allowed)
+		}
+	}
+}
+
+// stopReason returns why the run ended
+func (l *runLimit) stopReason() string {
+	if l == nil {
+		return "done"
+	}
+	select {
+	case <-l.done:
+		return l.reason
+	default:
+	}
+	return "done"
+}
@@ -0,0 +1,268 @@
+package cmd
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"time"
+)
+
+const loadProfileHelp = "how to vary the load over time, as a factor of the configured number of series per org: " +
+	"the feed sends points for that many series, so timestamps keep following the clock. one of flat|ramp|step|diurnal|burst, optionally followed by ':' and comma separated key=value params. " +
+	"profiles can be multiplied together with '*'. e.g. 'ramp:from=0.1,to=2,over=30m' or 'diurnal:period=1h*burst:factor=10,duration=30s,every=10m'"
+
+// LoadProfile modulates the load of a feed over time
+type LoadProfile interface {
+	Info() string
+	// Factor returns by how much to multiply the configured number of series, at the given (wall clock) time since the feed started
+	Factor(elapsed time.Duration) float64
+	// Max returns the highest factor the profile can return
+	Max() float64
+}
+
+// FlatProfile keeps the rate as configured
+// this is the traditional fakemetrics behavior
+type FlatProfile struct{}
+
+func (f FlatProfile) Info() string {
+	return "flat"
+}
+
+func (f FlatProfile) Factor(elapsed time.Duration) float64 {
+	return 1
+}
+
+func (f FlatProfile) Max() float64 {
+	return 1
+}
+
+// RampProfile changes the factor linearly from from to to, over the given duration,
+// and stays at to afterwards
+type RampProfile struct {
+	from, to float64
+	over     time.Duration
+}
+
+func (r RampProfile) Info() string {
+	return fmt.Sprintf("ramp:from=%g,to=%g,over=%s", r.from, r.to, r.over)
+}
+
+func (r RampProfile) Factor(elapsed time.Duration) float64 {
+	if elapsed >= r.over {
+		return r.to
+	}
+	return r.from + (r.to-r.from)*float64(elapsed)/float64(r.over)
+}
+
+func (r RampProfile) Max() float64 {
+	return math.Max(r.from, r.to)
+}
+
+// StepProfile changes the factor from from to to in a number of equal steps,
+// one step every given duration, and stays at to afterwards
+type StepProfile struct {
+	from, to float64
+	steps    int
+	every    time.Duration
+}
+
+func (s StepProfile) Info() string {
+	return fmt.Sprintf("step:from=%g,to=%g,steps=%d,every=%s", s.from, s.to, s.steps, s.every)
+}
+
+func (s StepProfile) Factor(elapsed time.Duration) float64 {
+	step := int(elapsed / s.every)
+	if step >= s.steps {
+		return s.to
+	}
+	return s.from + (s.to-s.from)*float64(step)/float64(s.steps)
+}
+
+func (s StepProfile) Max() float64 {
+	return math.Max(s.from, s.to)
+}
+
+// DiurnalProfile follows the daily pattern of a typical service, with one day compressed into period:
+// a sine that starts at its low at midnight and peaks at noon.
+type DiurnalProfile struct {
+	period   time.Duration
+	min, max float64
+}
+
+func (d DiurnalProfile) Info() string {
+	return fmt.Sprintf("diurnal:period=%s,min=%g,max=%g", d.period, d.min, d.max)
+}
+
+func (d DiurnalProfile) Factor(elapsed time.Duration) float64 {
+	phase := float64(elapsed%d.period) / float64(d.period)
+	return d.min + (d.max-d.min)*(1-math.Cos(2*math.Pi*phase))/2
+}
+
+func (d DiurnalProfile) Max() float64 {
+	return math.Max(d.min, d.max)
+}
+
+// BurstProfile multiplies the load by factor for the given duration, every so often.
+// the first burst starts after every has passed.
+type BurstProfile struct {
+	factor   float64
+	duration time.Duration
+	every    time.Duration
+}
+
+func (b BurstProfile) Info() string {
+	return fmt.Sprintf("burst:factor=%g,duration=%s,every=%s", b.factor, b.duration, b.every)
+}
+
+func (b BurstProfile) Factor(elapsed time.Duration) float64 {
+	if elapsed >= b.every && elapsed%b.every < b.duration {
+		return b.factor
+	}
+	return 1
+}
+
+func (b BurstProfile) Max() float64 {
+	return math.Max(b.factor, 1)
+}
+
+// ProductProfile multiplies the factors of several profiles, e.g. to add bursts on top of a diurnal pattern
+type ProductProfile []LoadProfile
+
+func (p ProductProfile) Info() string {
+	infos := make([]string, len(p))
+	for i, lp := range p {
+		infos[i] = lp.Info()
+	}
+	return strings.Join(infos, "*")
+}
+
+func (p ProductProfile) Factor(elapsed time.Duration) float64 {
+	f := 1.0
+	for _, lp := range p {
+		f *= lp.Factor(elapsed)
+	}
+	return f
+}
+
+func (p ProductProfile) Max() float64 {
+	f := 1.0
+	for _, lp := range p {
+		f *= lp.Max()
+	}
+	return f
+}
+
+// poolSize returns how many series per org a feed needs, to be able to follow the profile
+func poolSize(mpo int, profile LoadProfile) int {
+	if n := int(math.Ceil(float64(mpo) * profile.Max())); n > mpo {
+		return n
+	}
+	return mpo
+}
+
+// activeSeries returns how many of the series of the pool send points, at the given factor
+func activeSeries(mpo, pool int, factor float64) int {
+	if n := int(math.Round(float64(mpo) * factor)); n < pool {
+		return n
+	}
+	return pool
+}
+
+// NewLoadProfile creates a LoadProfile from a spec such as 'ramp:from=0.1,to=2,over=30m'
+// several specs separated by '*' result in a ProductProfile
+func NewLoadProfile(spec string) (LoadProfile, error) {
+	if strings.Contains(spec, "*") {
+		var p ProductProfile
+		for _, s := range strings.Split(spec, "*") {
+			lp, err := NewLoadProfile(strings.TrimSpace(s))
+			if err != nil {
+				return nil, err
+			}
+			p = append(p, lp)
+		}
+		return p, nil
+	}
+
+	profile, params, err := parseSpec(spec)
+	if err != nil {
+		return nil, fmt.Errorf("load profile %q: %s", profile, err)
+	}
+
+	// nonNegative reads a factor param
+	nonNegative := func(key string, def float64) (float64, error) {
+		v, err := params.float(key, def)
+		if err == nil && v < 0 {
+			err = fmt.Errorf("param %q must not be negative", key)
+		}
+		return v, err
+	}
+
+	var lp LoadProfile
+	switch profile {
+	case "", "flat":
+		lp = FlatProfile{}
+	case "ramp":
+		r := RampProfile{}
+		if r.from, err = nonNegative("from", 0); err != nil {
+			break
+		}
+		if r.to, err = nonNegative("to", 1); err != nil {
+			break
+		}
+		r.over, err = params.duration("over", 10*time.Minute)
+		lp = r
+	case "step":
+		s := StepProfile{}
+		if s.from, err = nonNegative("from", 0.1); err != nil {
+			break
+		}
+		if s.to, err = nonNegative("to", 1); err != nil {
+			break
+		}
+		var steps float64
+		if steps, err = params.float("steps", 9); err != nil {
+			break
+		}
+		if steps < 1 || steps != math.Trunc(steps) {
+			err = fmt.Errorf("param %q must be a whole number >= 1", "steps")
+			break
+		}
+		s.steps = int(steps)
+		s.every, err = params.duration("every", time.Minute)
+		lp = s
+	case "diurnal":
+		d := DiurnalProfile{}
+		if d.period, err = params.duration("period", 24*time.Hour); err != nil {
+			break
+		}
+		if d.min, err = nonNegative("min", 0.2); err != nil {
+			break
+		}
+		d.max, err = nonNegative("max", 1)
+		lp = d
+	case "burst":
+		b := BurstProfile{}
+		if b.factor, err = nonNegative("factor", 10); err != nil {
+			break
+		}
+		if b.duration, err = params.duration("duration", 30*time.Second); err != nil {
+			break
+		}
+		if b.every, err = params.duration("every", 10*time.Minute); err != nil {
+			break
+		}
+		if b.duration >= b.every {
+			err = fmt.Errorf("param %q must be less than %q", "duration", "every")
+		}
+		lp = b
+	default:
+		return nil, fmt.Errorf("unknown load profile %q", profile)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("load profile %q: %s", profile, err)
+	}
+	if err := params.unknown(); err != nil {
+		return nil, fmt.Errorf("load profile %q: %s", profile, err)
+	}
+	return lp, nil
+}
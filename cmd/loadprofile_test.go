@@ -0,0 +1,105 @@
+package cmd
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestNewLoadProfile(t *testing.T) {
+	cases := []struct {
+		spec    string
+		expInfo string
+		expErr  bool
+	}{
+		{"flat", "flat", false},
+		{"ramp:from=1,to=5,over=1h", "ramp:from=1,to=5,over=1h0m0s", false},
+		{"step:steps=4", "step:from=0.1,to=1,steps=4,every=1m0s", false},
+		{"diurnal:period=1h", "diurnal:period=1h0m0s,min=0.2,max=1", false},
+		{"diurnal:period=1h * burst", "diurnal:period=1h0m0s,min=0.2,max=1*burst:factor=10,duration=30s,every=10m0s", false},
+		{"ramp:from=-1", "", true},
+		{"step:steps=2.5", "", true},
+		{"burst:duration=10m,every=5m", "", true},
+		{"diurnal:period=0s", "", true},
+		{"flat*bogus", "", true},
+		{"ramp:foo=bar", "", true},
+	}
+	for _, c := range cases {
+		lp, err := NewLoadProfile(c.spec)
+		if c.expErr {
+			if err == nil {
+				t.Errorf("spec %q: expected error, got none", c.spec)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("spec %q: expected no error, got %s", c.spec, err)
+			continue
+		}
+		if lp.Info() != c.expInfo {
+			t.Errorf("spec %q: expected info %q, got %q", c.spec, c.expInfo, lp.Info())
+		}
+	}
+}
+
+func TestLoadProfileFactor(t *testing.T) {
+	cases := []struct {
+		spec    string
+		elapsed time.Duration
+		exp     float64
+	}{
+		{"ramp:from=1,to=3,over=10m", 0, 1},
+		{"ramp:from=1,to=3,over=10m", 5 * time.Minute, 2},
+		{"ramp:from=1,to=3,over=10m", time.Hour, 3},
+		{"step:from=0,to=1,steps=4,every=1m", 59 * time.Second, 0},
+		{"step:from=0,to=1,steps=4,every=1m", 2 * time.Minute, 0.5},
+		{"step:from=0,to=1,steps=4,every=1m", 10 * time.Minute, 1},
+		{"diurnal:period=24m,min=0.5,max=2", 0, 0.5},
+		{"diurnal:period=24m,min=0.5,max=2", 12 * time.Minute, 2},
+		{"diurnal:period=24m,min=0.5,max=2", 30 * time.Minute, 1.25},
+		{"burst:factor=10,duration=30s,every=10m", 10 * time.Second, 1},
+		{"burst:factor=10,duration=30s,every=10m", 20*time.Minute + 10*time.Second, 10},
+		{"burst:factor=10,duration=30s,every=10m", 20*time.Minute + 30*time.Second, 1},
+		{"ramp:from=0,to=2,over=10m*burst:factor=10,duration=1m,every=5m", 5 * time.Minute, 10},
+	}
+	for _, c := range cases {
+		lp, err := NewLoadProfile(c.spec)
+		if err != nil {
+			t.Fatalf("spec %q: %s", c.spec, err)
+		}
+		if f := lp.Factor(c.elapsed); math.Abs(f-c.exp) > 1e-9 {
+			t.Errorf("spec %q at %s: expected factor %f, got %f", c.spec, c.elapsed, c.exp, f)
+		}
+	}
+}
+
+func TestActiveSeries(t *testing.T) {
+	cases := []struct {
+		spec      string
+		mpo       int
+		expPool   int
+		elapsed   time.Duration
+		expActive int
+	}{
+		{"flat", 100, 100, time.Hour, 100},
+		{"ramp:from=0,to=1,over=10m", 100, 100, 0, 0},
+		{"ramp:from=0,to=1,over=10m", 100, 100, 5 * time.Minute, 50},
+		{"ramp:from=2,to=0.5,over=10m", 10, 20, 0, 20},
+		{"burst:factor=10,duration=30s,every=10m", 7, 70, 10*time.Minute + time.Second, 70},
+		{"burst:factor=10,duration=30s,every=10m", 7, 70, 11 * time.Minute, 7},
+		{"diurnal:min=0.1,max=0.5", 10, 10, 0, 1},
+	}
+	for _, c := range cases {
+		lp, err := NewLoadProfile(c.spec)
+		if err != nil {
+			t.Fatalf("spec %q: %s", c.spec, err)
+		}
+		pool := poolSize(c.mpo, lp)
+		if pool != c.expPool {
+			t.Errorf("spec %q: expected a pool of %d series, got %d", c.spec, c.expPool, pool)
+		}
+		if active := activeSeries(c.mpo, pool, lp.Factor(c.elapsed)); active != c.expActive {
+			t.Errorf("spec %q at %s: expected %d active series, got %d", c.spec, c.elapsed, c.expActive, active)
+		}
+	}
+}
@@ -1,6 +1,9 @@
 package cmd
 
-import "math/rand"
+import (
+	"math/rand"
+	"time"
+)
 
 const letterBytes = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
 const (
@@ -9,12 +12,30 @@ const (
 	letterIdxMax  = 63 / letterIdxBits   // # of letter indices fitting in 63 bits
 )
 
-func RandString(n int) string {
+// seedRand hands out the seeds of the generators returned by newRand
+var seedRand *rand.Rand
+
+// newRand returns a new random number generator.
+// with --seed set, the n-th call always returns a generator with the same sequence,
+// so it must be called in a deterministic order, and not from concurrent goroutines.
+// a rand.Rand is not safe for concurrent use, so each goroutine needs its own.
+func newRand() *rand.Rand {
+	if seedRand == nil {
+		s := seed
+		if s == 0 {
+			s = time.Now().UnixNano()
+		}
+		seedRand = rand.New(rand.NewSource(s))
+	}
+	return rand.New(rand.NewSource(seedRand.Int63()))
+}
+
+func RandString(rng *rand.Rand, n int) string {
 	b := make([]byte, n)
 	// A rand.Int63() generates 63 random bits, enough for letterIdxMax letters!
-	for i, cache, remain := n-1, rand.Int63(), letterIdxMax; i >= 0; {
+	for i, cache, remain := n-1, rng.Int63(), letterIdxMax; i >= 0; {
 		if remain == 0 {
-			cache, remain = rand.Int63(), letterIdxMax
+			cache, remain = rng.Int63(), letterIdxMax
 		}
 		if idx := int(cache & letterIdxMask); idx < len(letterBytes) {
 			b[i] = letterBytes[idx]
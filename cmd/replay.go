@@ -0,0 +1,127 @@
+// Copyright © 2018 Grafana Labs
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"io"
+	"time"
+
+	"github.com/raintank/fakemetrics/out"
+	"github.com/raintank/fakemetrics/out/file"
+	"github.com/raintank/worldping-api/pkg/log"
+	"github.com/spf13/cobra"
+)
+
+var (
+	replayFile  string
+	replaySpeed float64
+)
+
+var replayCmd = &cobra.Command{
+	Use:   "replay",
+	Short: "Replays a recording made with the file output",
+	Long: `Replays a recording made with the file output through the configured outputs.
+The recorded metrics are sent unmodified, including their timestamps.
+Batches are sent with the same spacing in between them as when they were recorded,
+divided by the speed. A speed of 0 sends them as fast as possible.
+The replay stops at the end of the recording, or earlier when interrupted,
+when the duration has elapsed or when the max amount of points has been sent.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if replayFile == "" {
+			log.Fatal(4, "a recording must be specified")
+		}
+		if replaySpeed < 0 {
+			log.Fatal(4, "speed must not be negative")
+		}
+		if fileOut == replayFile {
+			log.Fatal(4, "can't record to the recording being replayed")
+		}
+		r, err := file.NewReader(replayFile)
+		if err != nil {
+			log.Fatal(4, "can't open recording %q: %s", replayFile, err)
+		}
+		defer r.Close()
+
+		checkOutputs()
+		initStats(true, "replay")
+		lim := newRunLimit(runDuration, maxPoints)
+		lim.stopOnSignal()
+		outs := getOutputs()
+
+		var first time.Time
+		start := time.Now()
+		var batches, points int
+	loop:
+		for {
+			select {
+			case <-lim.Done():
+				break loop
+			default:
+			}
+			t, metrics, err := r.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				log.Error(0, "stopping replay after %d batches: %s", batches, err)
+				break
+			}
+			if batches == 0 {
+				first, start = t, time.Now()
+			} else if replaySpeed > 0 {
+				due := start.Add(time.Duration(float64(t.Sub(first)) / replaySpeed))
+				select {
+				case <-lim.Done():
+					break loop
+				case <-time.After(time.Until(due)):
+				}
+			}
+			metrics = metrics[:lim.take(len(metrics))]
+			if len(metrics) == 0 {
+				break
+			}
+
+			preFlush := time.Now()
+			for _, o := range outs {
+				if r.Full() {
+					err = out.FlushFull(o, metrics)
+				} else {
+					err = o.Flush(metrics)
+				}
+				if err != nil {
+					log.Error(0, "failed to send data to output: %s", err)
+				}
+			}
+			flushDuration.Value(time.Since(preFlush))
+			pointsGenerated.Inc(int64(len(metrics)))
+			batches++
+			points += len(metrics)
+		}
+		closeOutputs(outs)
+		log.Info("replayed %d points in %d batches in %s", points, batches, time.Since(start))
+		if r.Skipped() > 0 {
+			log.Warn("skipped %d entries of the recording that could not be decoded", r.Skipped())
+		}
+		finishRun(lim)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(replayCmd)
+	replayCmd.Flags().StringVar(&replayFile, "file", "", "recording to replay")
+	replayCmd.Flags().Float64Var(&replaySpeed, "speed", 1, "speed relative to the recording. e.g. 2 for twice as fast. 0 for as fast as possible")
+	replayCmd.Flags().DurationVar(&runDuration, "duration", 0, "how long to run for. 0 to run until the end of the recording or interrupted")
+	replayCmd.Flags().Int64Var(&maxPoints, "max-points", 0, "stop after sending this many points. 0 for no limit")
+}
@@ -0,0 +1,460 @@
+// Copyright © 2018 Grafana Labs
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/bits"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/raintank/met"
+	"github.com/raintank/worldping-api/pkg/log"
+)
+
+// recorder is a met.Backend that keeps track of all stats in-process,
+// in addition to passing them on to the wrapped backend.
+// stats with the same key share their state, so e.g. the stats of all outputs
+// of the same type are aggregated together.
+type recorder struct {
+	sync.Mutex
+	backend met.Backend
+	start   time.Time
+	counts  map[string]*int64
+	gauges  map[string]*int64
+	timers  map[string]*histogram
+	meters  map[string]*meterSum
+	// the rate in points/s we're trying to achieve, and the amount of points we should have sent
+	// as of the last change of that rate. protected by the lock
+	targetRate   float64
+	targetPoints float64
+	targetSince  time.Time
+}
+
+func newRecorder(backend met.Backend) *recorder {
+	now := time.Now()
+	return &recorder{
+		backend: backend,
+		start:   now,
+		counts:  make(map[string]*int64),
+		gauges:  make(map[string]*int64),
+		timers:  make(map[string]*histogram),
+		meters:  make(map[string]*meterSum),
+
+		targetSince: now,
+	}
+}
+
+func (r *recorder) NewCount(key string) met.Count {
+	r.Lock()
+	defer r.Unlock()
+	c, ok := r.counts[key]
+	if !ok {
+		c = new(int64)
+		r.counts[key] = c
+	}
+	return recordedCount{c, r.backend.NewCount(key)}
+}
+
+func (r *recorder) NewGauge(key string, val int64) met.Gauge {
+	r.Lock()
+	defer r.Unlock()
+	// gauges may be shared, e.g. by feeds that run concurrently. only the first one sets the initial value
+	g, ok := r.gauges[key]
+	if !ok {
+		g = new(int64)
+		*g = val
+		r.gauges[key] = g
+	}
+	return recordedGauge{g, r.backend.NewGauge(key, val)}
+}
+
+func (r *recorder) NewMeter(key string, val int64) met.Meter {
+	r.Lock()
+	defer r.Unlock()
+	m, ok := r.meters[key]
+	if !ok {
+		m = &meterSum{}
+		r.meters[key] = m
+	}
+	return recordedMeter{m, r.backend.NewMeter(key, val)}
+}
+
+func (r *recorder) NewTimer(key string, val time.Duration) met.Timer {
+	r.Lock()
+	defer r.Unlock()
+	h, ok := r.timers[key]
+	if !ok {
+		h = &histogram{}
+		r.timers[key] = h
+	}
+	return recordedTimer{h, r.backend.NewTimer(key, val)}
+}
+
+// addTargetRate adds to the rate in points/s we're trying to achieve.
+// feeds that run concurrently each add their own rate, and adjust it when their rate changes.
+func (r *recorder) addTargetRate(rate float64) {
+	if r == nil {
+		return
+	}
+	r.Lock()
+	r.updateTarget(time.Now())
+	r.targetRate += rate
+	r.Unlock()
+}
+
+// updateTarget accounts for the points we should have sent up to now, at the current target rate.
+// caller must hold the lock
+func (r *recorder) updateTarget(now time.Time) {
+	r.targetPoints += r.targetRate * now.Sub(r.targetSince).Seconds()
+	r.targetSince = now
+}
+
+func (r *recorder) count(key string) int64 {
+	c, ok := r.counts[key]
+	if !ok {
+		return 0
+	}
+	return atomic.LoadInt64(c)
+}
+
+func (r *recorder) gauge(key string) int64 {
+	g, ok := r.gauges[key]
+	if !ok {
+		return 0
+	}
+	return atomic.LoadInt64(g)
+}
+
+func (r *recorder) latency(key string) Latency {
+	h, ok := r.timers[key]
+	if !ok {
+		return Latency{}
+	}
+	return h.latency()
+}
+
+type recordedCount struct {
+	val *int64
+	met.Count
+}
+
+func (c recordedCount) Inc(val int64) {
+	atomic.AddInt64(c.val, val)
+	c.Count.Inc(val)
+}
+
+type recordedGauge struct {
+	val *int64
+	met.Gauge
+}
+
+func (g recordedGauge) Inc(val int64) {
+	atomic.AddInt64(g.val, val)
+	g.Gauge.Inc(val)
+}
+
+func (g recordedGauge) Dec(val int64) {
+	atomic.AddInt64(g.val, -val)
+	g.Gauge.Dec(val)
+}
+
+func (g recordedGauge) Value(val int64) {
+	atomic.StoreInt64(g.val, val)
+	g.Gauge.Value(val)
+}
+
+type meterSum struct {
+	sum int64 // accessed atomically
+}
+
+type recordedMeter struct {
+	m *meterSum
+	met.Meter
+}
+
+func (m recordedMeter) Value(val int64) {
+	atomic.AddInt64(&m.m.sum, val)
+	m.Meter.Value(val)
+}
+
+type recordedTimer struct {
+	h *histogram
+	met.Timer
+}
+
+func (t recordedTimer) Value(val time.Duration) {
+	t.h.add(val)
+	t.Timer.Value(val)
+}
+
+// histogram tracks a distribution of durations with log-linear buckets:
+// each power of 2 is divided into 16 buckets, giving percentiles within ~6% of the actual value
+type histogram struct {
+	sync.Mutex
+	buckets [64 * 16]uint64
+	count   uint64
+	max     time.Duration
+}
+
+func bucketFor(d time.Duration) int {
+	if d <= 0 {
+		return 0
+	}
+	v := uint64(d)
+	exp := bits.Len64(v) - 1
+	if exp < 4 {
+		return int(v)
+	}
+	return exp*16 + int((v>>uint(exp-4))&15)
+}
+
+// bucketMax returns the highest duration that falls in the given bucket
+func bucketMax(i int) time.Duration {
+	exp, sub := i/16, i%16
+	if exp < 4 {
+		return time.Duration(i)
+	}
+	return time.Duration((uint64(16+sub+1) << uint(exp-4)) - 1)
+}
+
+func (h *histogram) add(d time.Duration) {
+	h.Lock()
+	h.buckets[bucketFor(d)]++
+	h.count++
+	if d > h.max {
+		h.max = d
+	}
+	h.Unlock()
+}
+
+// percentile returns the duration below which the given fraction of the values fall
+// caller must hold the lock
+func (h *histogram) percentile(q float64) time.Duration {
+	if h.count == 0 {
+		return 0
+	}
+	target := uint64(q*float64(h.count) + 0.5)
+	if target == 0 {
+		target = 1
+	}
+	var seen uint64
+	for i, n := range h.buckets {
+		seen += n
+		if seen >= target {
+			if d := bucketMax(i); d < h.max {
+				return d
+			}
+			return h.max
+		}
+	}
+	return h.max
+}
+
+func (h *histogram) latency() Latency {
+	h.Lock()
+	defer h.Unlock()
+	return Latency{
+		Count: h.count,
+		P50:   h.percentile(0.50),
+		P90:   h.percentile(0.90),
+		P99:   h.percentile(0.99),
+		Max:   h.max,
+	}
+}
+
+// Latency summarizes the distribution of a duration
+type Latency struct {
+	Count uint64        `json:"count"`
+	P50   time.Duration `json:"p50_ns"`
+	P90   time.Duration `json:"p90_ns"`
+	P99   time.Duration `json:"p99_ns"`
+	Max   time.Duration `json:"max_ns"`
+}
+
+func (l Latency) String() string {
+	if l.Count == 0 {
+		return "n/a"
+	}
+	return fmt.Sprintf("p50=%s p90=%s p99=%s max=%s (n=%d)", l.P50, l.P90, l.P99, l.Max, l.Count)
+}
+
+// OutputReport is the part of the report about a single type of output
+type OutputReport struct {
+	PublishedMetrics  int64   `json:"published_metrics"`
+	PublishedMessages int64   `json:"published_messages"`
+	Bytes             int64   `json:"bytes"`
+	Errors            int64   `json:"errors"`
+	Reconnects        int64   `json:"reconnects"`
+	Flush             Latency `json:"flush_latency"`
+	Publish           Latency `json:"publish_latency"`
+}
+
+// FaultsReport counts the injected faults
+type FaultsReport struct {
+	Dropped         int64            `json:"dropped"`
+	Gaps            int64            `json:"gaps"`
+	GapPoints       int64            `json:"gap_points"`
+	NaN             int64            `json:"nan"`
+	Inf             int64            `json:"inf"`
+	Float32Overflow int64            `json:"float32_overflow"`
+	Invalid         map[string]int64 `json:"invalid"` // points per kind of invalid data
+}
+
+func (f FaultsReport) empty() bool {
+	return f.Dropped == 0 && f.Gaps == 0 && f.GapPoints == 0 && f.NaN == 0 && f.Inf == 0 && f.Float32Overflow == 0
+}
+
+func (f FaultsReport) String() string {
+	return fmt.Sprintf("%d dropped, %d gaps (%d points), %d NaN, %d Inf, %d float32 overflows", f.Dropped, f.Gaps, f.GapPoints, f.NaN, f.Inf, f.Float32Overflow)
+}
+
+// invalidString describes the amount of points of each kind of invalid data, in the order of invalidClasses
+func (f FaultsReport) invalidString() string {
+	var parts []string
+	for _, c := range invalidClasses {
+		if n := f.Invalid[c.key]; n > 0 {
+			parts = append(parts, fmt.Sprintf("%d %s", n, c.key))
+		}
+	}
+	return strings.Join(parts, ", ")
+}
+
+// Report describes how a run went
+type Report struct {
+	Duration     time.Duration           `json:"duration_ns"`
+	StopReason   string                  `json:"stop_reason"`
+	Points       int64                   `json:"points"`
+	PointsPerSec float64                 `json:"points_per_sec"`
+	TargetPerSec float64                 `json:"target_points_per_sec"`
+	Series       int64                   `json:"series_created"` // including the ones replaced by churn
+	BehindTicks  int64                   `json:"behind_ticks"`
+	MissedTicks  int64                   `json:"missed_ticks"`
+	Lag          time.Duration           `json:"lag_ns"`
+	Flush        Latency                 `json:"flush_latency"`
+	Faults       FaultsReport            `json:"faults"`
+	Outputs      map[string]OutputReport `json:"outputs"`
+}
+
+// report builds the report of everything recorded so far
+func (r *recorder) report(stopReason string) Report {
+	r.Lock()
+	defer r.Unlock()
+	now := time.Now()
+	r.updateTarget(now)
+	rep := Report{
+		Duration:    now.Sub(r.start),
+		StopReason:  stopReason,
+		Points:      r.count("metricpublisher.global.points_generated"),
+		Series:      r.count("metricpublisher.global.series_created"),
+		BehindTicks: r.count("metricpublisher.global.behind_ticks"),
+		MissedTicks: r.gauge("metricpublisher.global.missed_ticks"),
+		Lag:         time.Duration(r.gauge("metricpublisher.global.lag_ms")) * time.Millisecond,
+		Flush:       r.latency("metricpublisher.global.flush_duration"),
+		Outputs:     make(map[string]OutputReport),
+	}
+	rep.Faults = FaultsReport{
+		Dropped:         r.count("metricpublisher.global.faults_dropped"),
+		Gaps:            r.count("metricpublisher.global.faults_gaps"),
+		GapPoints:       r.count("metricpublisher.global.faults_gap_points"),
+		NaN:             r.count("metricpublisher.global.faults_nan"),
+		Inf:             r.count("metricpublisher.global.faults_inf"),
+		Float32Overflow: r.count("metricpublisher.global.faults_float32_overflow"),
+		Invalid:         make(map[string]int64),
+	}
+	for _, c := range invalidClasses {
+		rep.Faults.Invalid[c.key] = r.count(c.stat())
+	}
+	rep.PointsPerSec = float64(rep.Points) / rep.Duration.Seconds()
+	// the average of the target rate over the run, since it may vary
+	rep.TargetPerSec = r.targetPoints / rep.Duration.Seconds()
+
+	for key := range r.timers {
+		if !strings.HasPrefix(key, "metricpublisher.out.") || !strings.HasSuffix(key, ".flush_duration") {
+			continue
+		}
+		name := strings.TrimSuffix(strings.TrimPrefix(key, "metricpublisher.out."), ".flush_duration")
+		prefix := "metricpublisher.out." + name + "."
+		var bytes int64
+		if m, ok := r.meters[prefix+"message_bytes"]; ok {
+			bytes = atomic.LoadInt64(&m.sum)
+		}
+		rep.Outputs[name] = OutputReport{
+			PublishedMetrics:  r.count(prefix + "published_metrics"),
+			PublishedMessages: r.count(prefix + "published_messages"),
+			Bytes:             bytes,
+			Errors:            r.count(prefix + "publish_errors"),
+			Reconnects:        r.count(prefix + "reconnects"),
+			Flush:             r.latency(prefix + "flush_duration"),
+			Publish:           r.latency(prefix + "publish_duration"),
+		}
+	}
+	return rep
+}
+
+func (rep Report) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "run took %s. stopped because: %s\n", rep.Duration, rep.StopReason)
+	fmt.Fprintf(&b, "points:       %d (%.1f points/s", rep.Points, rep.PointsPerSec)
+	if rep.TargetPerSec > 0 {
+		fmt.Fprintf(&b, ", target %.1f points/s, %.1f%%", rep.TargetPerSec, 100*rep.PointsPerSec/rep.TargetPerSec)
+	}
+	fmt.Fprintf(&b, ")\nseries:       %d created\nbehind ticks: %d\nmissed ticks: %d (lagging %s)\nflush:        %s\n", rep.Series, rep.BehindTicks, rep.MissedTicks, rep.Lag, rep.Flush)
+
+	if !rep.Faults.empty() {
+		fmt.Fprintf(&b, "faults:       %s\n", rep.Faults)
+	}
+	if invalid := rep.Faults.invalidString(); invalid != "" {
+		fmt.Fprintf(&b, "invalid:      %s\n", invalid)
+	}
+
+	names := make([]string, 0, len(rep.Outputs))
+	for name := range rep.Outputs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		o := rep.Outputs[name]
+		fmt.Fprintf(&b, "output %s: %d metrics in %d messages, %d bytes, %d errors, %d reconnects\n", name, o.PublishedMetrics, o.PublishedMessages, o.Bytes, o.Errors, o.Reconnects)
+		fmt.Fprintf(&b, "  flush:   %s\n", o.Flush)
+		fmt.Fprintf(&b, "  publish: %s\n", o.Publish)
+	}
+	return b.String()
+}
+
+// finishRun prints the report of the run, and writes it as json if requested
+func finishRun(lim *runLimit) {
+	if recorded == nil {
+		return
+	}
+	rep := recorded.report(lim.stopReason())
+	fmt.Print(rep)
+	if reportJSON == "" {
+		return
+	}
+	data, err := json.MarshalIndent(rep, "", "  ")
+	if err != nil {
+		log.Error(0, "failed to encode report: %s", err)
+		return
+	}
+	if err := ioutil.WriteFile(reportJSON, append(data, '\n'), 0644); err != nil {
+		log.Error(0, "failed to write report: %s", err)
+	}
+}
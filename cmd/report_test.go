@@ -0,0 +1,56 @@
+package cmd
+
+import (
+	"testing"
+	"time"
+
+	"github.com/raintank/fakemetrics/promstats"
+)
+
+func TestHistogramPercentiles(t *testing.T) {
+	h := &histogram{}
+	for i := 1; i <= 1000; i++ {
+		h.add(time.Duration(i) * time.Millisecond)
+	}
+	l := h.latency()
+	if l.Count != 1000 {
+		t.Fatalf("expected count 1000, got %d", l.Count)
+	}
+	if l.Max != time.Second {
+		t.Fatalf("expected max 1s, got %s", l.Max)
+	}
+	cases := []struct {
+		got, exp time.Duration
+	}{
+		{l.P50, 500 * time.Millisecond},
+		{l.P90, 900 * time.Millisecond},
+		{l.P99, 990 * time.Millisecond},
+	}
+	for i, c := range cases {
+		// buckets are at most 1/16th of their power of 2 wide
+		if c.got < c.exp || c.got > c.exp+c.exp/16 {
+			t.Fatalf("case %d: expected about %s, got %s", i, c.exp, c.got)
+		}
+	}
+}
+
+func TestHistogramSmallValues(t *testing.T) {
+	h := &histogram{}
+	h.add(0)
+	h.add(3)
+	h.add(3)
+	l := h.latency()
+	if l.P50 != 3 || l.Max != 3 {
+		t.Fatalf("expected p50 and max of 3ns, got %s and %s", l.P50, l.Max)
+	}
+}
+
+func TestRecorderSharedGauge(t *testing.T) {
+	r := newRecorder(promstats.New())
+	r.NewGauge("metricpublisher.global.lag_ms", 5).Inc(10)
+	// another feed getting the same gauge must not reset it
+	r.NewGauge("metricpublisher.global.lag_ms", 0).Inc(1)
+	if got := r.gauge("metricpublisher.global.lag_ms"); got != 16 {
+		t.Fatalf("expected gauge of 16, got %d", got)
+	}
+}
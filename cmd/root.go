@@ -19,6 +19,7 @@ import (
 	"net/http"
 	_ "net/http/pprof"
 	"os"
+	"strings"
 	"time"
 
 	homedir "github.com/mitchellh/go-homedir"
@@ -26,6 +27,7 @@ import (
 	"github.com/raintank/met"
 	"github.com/raintank/worldping-api/pkg/log"
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
 	"github.com/spf13/viper"
 )
 
@@ -34,6 +36,8 @@ var rootCmd = &cobra.Command{
 	Short: "Generates fake metrics workload",
 	PersistentPreRun: func(cmd *cobra.Command, args []string) {
 
+		applyConfig(cmd)
+
 		log.NewLogger(0, "console", fmt.Sprintf(`{"level": %d, "formatting":true}`, logLevel))
 
 		if listenAddr != "" {
@@ -64,61 +68,137 @@ var (
 	statsdAddr string
 	statsdType string
 
+	statsBackend string
+
 	addTags             bool
 	numUniqueTags       int
 	customTags          []string
 	numUniqueCustomTags int
+	tagCardinalitySpec  string
 
 	kafkaMdmAddr     string
 	kafkaMdmTopic    string
 	kafkaMdmV2       bool
+	kafkaMdmFormat   string
 	kafkaMdamAddr    string
 	kafkaCompression string
 	partitionScheme  string
 	carbonAddr       string
+	carbonTags       bool
+	carbonOrgPrefix  string
+	carbonProto      string
+	carbonTransport  string
+	carbonMaxBytes   int
+	carbonMTU        int
 	gnetAddr         string
 	gnetKey          string
+	gnetKeyFile      string
+	influxAddr       string
+	influxPrecision  string
+	influxBatch      int
+	influxNodes      int
+	opentsdbAddr     string
+	opentsdbOrgTag   string
+	opentsdbBatch    int
+	promrwAddr       string
+	promrwBatch      int
+	statsdOutAddr    string
+	statsdOutType    string
+	statsdOutPacket  int
+	fileOut          string
+	fileFormat       string
+	fileGzip         bool
 	stdoutOut        bool
 
-	metricName string
-	orgs       int
-	mpo        int
-	flushDur   time.Duration
-	periodDur  time.Duration
-	flush      int // in ms
-	period     int // in s
-	offset     time.Duration
-	speedup    int
+	metricName  string
+	valueModel  string
+	loadProfile string
+	orgs        int
+	mpo         int
+	flushDur    time.Duration
+	periodDur   time.Duration
+	flush       int // in ms
+	period      int // in s
+	offset      time.Duration
+	speedup     int
+
+	runDuration time.Duration
+	maxPoints   int64
+	maxLag      time.Duration
+
+	churnPct      float64
+	churnInterval time.Duration
+
+	intervalDistribution string
+	faultSpec            string
+
+	reportJSON string
+	seed       int64
 
 	// global vars
-	outs          []out.Out
-	stats         met.Backend
-	flushDuration met.Timer
+	outs            []out.Out
+	stats           met.Backend
+	recorded        *recorder
+	flushDuration   met.Timer
+	pointsGenerated met.Count
+	behindTicks     met.Count // ticks after which we were still busy when the next one was due
+	missedTicks     met.Gauge // ticks dropped because we were too slow, summed over all feeds
+	lagMs           met.Gauge // how far behind schedule we are, summed over all feeds
+	seriesActive    met.Gauge // series we're currently sending, summed over all feeds
+	seriesCreated   met.Count // series we've ever sent, including the ones replaced by churn
+	faultStats      faultCounters
 )
 
 func init() {
 	cobra.OnInitialize(initConfig)
 
 	rootCmd.PersistentFlags().StringVar(&cfgFile, "config", "", "config file (default is $HOME/.fakemetrics.yaml)")
-	rootCmd.PersistentFlags().StringVar(&listenAddr, "listen", ":6764", "http listener address for pprof.")
+	rootCmd.PersistentFlags().StringVar(&listenAddr, "listen", ":6764", "http listener address for pprof, the control api (see /status), and /metrics when using the prometheus stats backend.")
 	rootCmd.PersistentFlags().IntVar(&logLevel, "log-level", 2, "log level. 0=TRACE|1=DEBUG|2=INFO|3=WARN|4=ERROR|5=CRITICAL|6=FATAL")
 	rootCmd.PersistentFlags().StringVar(&statsdAddr, "statsd-addr", "", "statsd TCP address. e.g. 'localhost:8125'")
 	rootCmd.PersistentFlags().StringVar(&statsdType, "statsd-type", "standard", "statsd type: standard or datadog")
+	rootCmd.PersistentFlags().StringVar(&statsBackend, "stats-backend", "statsd", "where to send our own stats: statsd (see statsd-addr) or prometheus (served on /metrics of the listener)")
+	rootCmd.PersistentFlags().StringVar(&reportJSON, "report-json", "", "file to write the end-of-run report to, in json")
+	rootCmd.PersistentFlags().Int64Var(&seed, "seed", 0, "seed for the random values, names and agent start offsets. runs with the same seed and settings generate the same series and values. timestamps are not reproducible: they follow the clock, as do the flush times in recordings of the file output. 0 for a random seed")
 
 	rootCmd.PersistentFlags().BoolVarP(&addTags, "add-tags", "t", false, "add the built-in tags to generated metrics (default false)")
 	rootCmd.PersistentFlags().IntVar(&numUniqueTags, "num-unique-tags", 1, "a number between 0 and 10. when using add-tags this will add a unique number to some built-in tags")
 	rootCmd.PersistentFlags().StringSliceVar(&customTags, "custom-tags", []string{}, "A list of comma separated tags (i.e. \"tag1=value1,tag2=value2\")(default empty) conflicts with add-tags")
 	rootCmd.PersistentFlags().IntVar(&numUniqueCustomTags, "num-unique-custom-tags", 0, "a number between 0 and the length of custom-tags. when using custom-tags this will make the tags unique (default 0)")
+	rootCmd.PersistentFlags().StringVar(&tagCardinalitySpec, "tag-cardinality", "", tagCardinalityHelp)
 
 	rootCmd.PersistentFlags().StringVar(&kafkaMdmAddr, "kafka-mdm-addr", "", "kafka TCP address for MetricData-Msgp messages. e.g. localhost:9092")
 	rootCmd.PersistentFlags().StringVar(&kafkaMdmTopic, "kafka-mdm-topic", "mdm", "kafka topic for MetricData-Msgp messages")
 	rootCmd.PersistentFlags().BoolVar(&kafkaMdmV2, "kafka-mdm-v2", true, "enable MetricPoint optimization (send MetricData first, then optimized MetricPoint payloads)")
+	rootCmd.PersistentFlags().StringVar(&kafkaMdmFormat, "kafka-mdm-format", "", "kafka-mdm wire format: metricdata (always full MetricData), metricpoint (MetricData the first time a series is seen, MetricPoint after that), metricpoint-without-org (like metricpoint, but the smaller MetricPointWithoutOrg, for which metrictank assumes org 1. so only for 1 org) or auto (metricpoint-without-org for org 1, metricpoint for other orgs). overrides kafka-mdm-v2 (default metricpoint, or metricdata if kafka-mdm-v2 is false)")
 	rootCmd.PersistentFlags().StringVar(&kafkaMdamAddr, "kafka-mdam-addr", "", "kafka TCP address for MetricDataArray-Msgp messages. e.g. localhost:9092")
 	rootCmd.PersistentFlags().StringVar(&kafkaCompression, "kafka-comp", "snappy", "compression: none|gzip|snappy")
 	rootCmd.PersistentFlags().StringVar(&partitionScheme, "partition-scheme", "bySeries", "method used for partitioning metrics (kafka-mdm-only). (byOrg|bySeries|bySeriesWithTags|bySeriesWithTagsFnv|lastNum)")
-	rootCmd.PersistentFlags().StringVar(&carbonAddr, "carbon-addr", "", "carbon TCP address. e.g. localhost:2003")
+	rootCmd.PersistentFlags().StringVar(&carbonAddr, "carbon-addr", "", "carbon address. e.g. localhost:2003")
+	rootCmd.PersistentFlags().BoolVar(&carbonTags, "carbon-tags", false, "include tags in carbon output using the graphite 1.1 tagged series syntax (name;tag=value)")
+	rootCmd.PersistentFlags().StringVar(&carbonOrgPrefix, "carbon-org-prefix", "", "prefix for carbon metric names, required to simulate more than 1 org. {org} is replaced by the org id. e.g. 'org_{org}.'")
+	rootCmd.PersistentFlags().StringVar(&carbonProto, "carbon-proto", "plain", "carbon protocol: plain|pickle")
+	rootCmd.PersistentFlags().StringVar(&carbonTransport, "carbon-transport", "tcp", "carbon transport: tcp|udp (pickle requires tcp)")
+	rootCmd.PersistentFlags().IntVar(&carbonMaxBytes, "carbon-max-bytes", 64*1024, "max size of a carbon pickle message in bytes")
+	rootCmd.PersistentFlags().IntVar(&carbonMTU, "carbon-mtu", 1500, "MTU to keep carbon udp datagrams within")
 	rootCmd.PersistentFlags().StringVar(&gnetAddr, "gnet-addr", "", "gnet address. e.g. http://localhost:8081")
-	rootCmd.PersistentFlags().StringVar(&gnetKey, "gnet-key", "", "gnet api key")
+	rootCmd.PersistentFlags().StringVar(&gnetKey, "gnet-key", "", "gnet api key. {org} is replaced by the org id, to use a different key per org. e.g. 'key-{org}'")
+	rootCmd.PersistentFlags().StringVar(&gnetKeyFile, "gnet-key-file", "", "file with a gnet api key per org, one 'orgid key' pair per line. overrides gnet-key")
+	rootCmd.PersistentFlags().StringVar(&influxAddr, "influx-addr", "", "influx line protocol address. http url of the write endpoint, or udp address. e.g. http://localhost:8086/write?db=fakemetrics or udp://localhost:8089")
+	rootCmd.PersistentFlags().StringVar(&influxPrecision, "influx-precision", "s", "influx timestamp precision: s|ms|u|ns")
+	rootCmd.PersistentFlags().IntVar(&influxBatch, "influx-batch", 5000, "max number of points per influx http request")
+	rootCmd.PersistentFlags().IntVar(&influxNodes, "influx-measurement-nodes", 0, "number of leading nodes of the metric name to use as influx measurement, the rest goes into the 'series' tag. 0 to use the whole name")
+	rootCmd.PersistentFlags().StringVar(&opentsdbAddr, "opentsdb-addr", "", "opentsdb address. tcp address for put lines, or http url of the put endpoint. e.g. localhost:4242 or http://localhost:4242/api/put")
+	rootCmd.PersistentFlags().StringVar(&opentsdbOrgTag, "opentsdb-org-tag", "org", "name of the opentsdb tag to store the org id in. empty to disable (note: opentsdb requires at least 1 tag per point)")
+	rootCmd.PersistentFlags().IntVar(&opentsdbBatch, "opentsdb-batch", 500, "max number of points per opentsdb http request")
+	rootCmd.PersistentFlags().StringVar(&promrwAddr, "promrw-addr", "", "prometheus remote write url. e.g. http://localhost:9090/api/v1/write")
+	rootCmd.PersistentFlags().IntVar(&promrwBatch, "promrw-batch", 5000, "max number of series per prometheus remote write request")
+	rootCmd.PersistentFlags().StringVar(&statsdOutAddr, "statsd-out-addr", "", "statsd UDP address to send the generated metrics to. e.g. localhost:8125 (not to be confused with statsd-addr)")
+	rootCmd.PersistentFlags().StringVar(&statsdOutType, "statsd-out-type", "standard", "statsd type for the generated metrics: standard or datadog (only datadog supports tags)")
+	rootCmd.PersistentFlags().IntVar(&statsdOutPacket, "statsd-out-packet-size", 1432, "max size of a statsd UDP packet in bytes")
+	rootCmd.PersistentFlags().StringVar(&fileOut, "file-out", "", "file to record all flushed metrics to, for use with the replay command")
+	rootCmd.PersistentFlags().StringVar(&fileFormat, "file-format", "metricdata", "format of the recording: metricdata (always full MetricData) or metricpoint (MetricData the first time a series is seen, MetricPoint after that)")
+	rootCmd.PersistentFlags().BoolVar(&fileGzip, "file-gzip", false, "gzip the recording")
 	rootCmd.PersistentFlags().BoolVar(&stdoutOut, "stdout", false, "enable emitting metrics to stdout")
 }
 
@@ -140,10 +220,38 @@ func initConfig() {
 		viper.SetConfigName(".fakemetrics")
 	}
 
+	viper.SetEnvKeyReplacer(strings.NewReplacer("-", "_"))
 	viper.AutomaticEnv() // read in environment variables that match
 
 	// If a config file is found, read it in.
 	if err := viper.ReadInConfig(); err == nil {
 		fmt.Println("Using config file:", viper.ConfigFileUsed())
 	}
+
+	// a scenario file may also set any of the flags, taking precedence over the config file.
+	if scenarioFile != "" {
+		viper.SetConfigFile(scenarioFile)
+		if err := viper.MergeInConfig(); err != nil {
+			fmt.Printf("can't read scenario file %q: %s\n", scenarioFile, err)
+			os.Exit(1)
+		}
+	}
+}
+
+// applyConfig sets all flags of the command that were not explicitly set on the command line,
+// to their value from the config file or environment, if present.
+func applyConfig(cmd *cobra.Command) {
+	cmd.Flags().VisitAll(func(f *pflag.Flag) {
+		if f.Changed || !viper.IsSet(f.Name) {
+			return
+		}
+		val := viper.GetString(f.Name)
+		if f.Value.Type() == "stringSlice" {
+			val = strings.Join(viper.GetStringSlice(f.Name), ",")
+		}
+		if err := cmd.Flags().Set(f.Name, val); err != nil {
+			fmt.Printf("invalid value %q for %s in config: %s\n", val, f.Name, err)
+			os.Exit(1)
+		}
+	})
 }
@@ -0,0 +1,282 @@
+// Copyright © 2018 Grafana Labs
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/raintank/fakemetrics/out"
+	"github.com/raintank/worldping-api/pkg/log"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var scenarioFile string
+
+// Workload is a single named workload from a scenario file
+type Workload struct {
+	Name                string        `mapstructure:"name"`
+	Builder             string        `mapstructure:"builder"` // simple or tagged
+	MetricName          string        `mapstructure:"metricname"`
+	Orgs                int           `mapstructure:"orgs"`
+	Mpo                 int           `mapstructure:"mpo"`
+	Period              time.Duration `mapstructure:"period"`
+	Flush               time.Duration `mapstructure:"flush"`
+	Offset              time.Duration `mapstructure:"offset"` // if set, backfills from now-offset and stops when now is reached
+	Speedup             int           `mapstructure:"speedup"`
+	ValueModel          string        `mapstructure:"value-model"`
+	AddTags             bool          `mapstructure:"add-tags"`
+	NumUniqueTags       int           `mapstructure:"num-unique-tags"`
+	CustomTags          []string      `mapstructure:"custom-tags"`
+	NumUniqueCustomTags int           `mapstructure:"num-unique-custom-tags"`
+	TagCardinality      string        `mapstructure:"tag-cardinality"`
+	Outputs             []string      `mapstructure:"outputs"`  // names of the outputs to use. all configured outputs if empty
+	Start               time.Duration `mapstructure:"start"`    // how long to wait after the scenario starts, before starting this workload
+	Duration            time.Duration `mapstructure:"duration"` // how long to run the workload. forever if 0
+	MaxLag              time.Duration `mapstructure:"max-lag"`  // fail the workload when falling further behind schedule than this. never if 0
+	LoadProfile         string        `mapstructure:"load-profile"`
+	ChurnPct            float64       `mapstructure:"churn-pct"`
+	ChurnInterval       time.Duration `mapstructure:"churn-interval"` // churn is disabled if 0
+	IntervalDist        string        `mapstructure:"interval-distribution"`
+	Faults              string        `mapstructure:"faults"`
+
+	builder MetricPayloadBuilder
+	vg      ValueGenerator
+	profile LoadProfile
+	churn   *churner
+	dist    IntervalDistribution
+	faults  *faultInjector
+	outs    []out.Out
+}
+
+// newWorkload returns a workload with the same defaults as the feed command
+func newWorkload() Workload {
+	return Workload{
+		Builder:       "tagged",
+		MetricName:    "some.id.of.a.metric",
+		Orgs:          1,
+		Mpo:           100,
+		Period:        time.Second,
+		Flush:         time.Second,
+		Speedup:       1,
+		ValueModel:    "random",
+		LoadProfile:   "flat",
+		ChurnPct:      10,
+		IntervalDist:  "fixed",
+		NumUniqueTags: 1,
+	}
+}
+
+// prepare validates the workload and sets up its builder, value generator and outputs
+func (w *Workload) prepare(outs map[string]out.Out) error {
+	if w.Name == "" {
+		return errors.New("workload has no name")
+	}
+	if w.Period%time.Second != 0 {
+		return errors.New("period must be a multiple of 1s")
+	}
+	if err := checkRate(w.Orgs, w.Mpo, int(w.Period.Seconds()), int(w.Flush/time.Millisecond), w.Speedup); err != nil {
+		return err
+	}
+
+	switch w.Builder {
+	case "simple":
+		w.builder = SimpleBuilder{w.MetricName}
+	case "tagged":
+		card, err := parseTagCardinality(w.TagCardinality)
+		if err != nil {
+			return err
+		}
+		tb := TaggedBuilder{w.MetricName, w.AddTags, w.NumUniqueTags, w.CustomTags, w.NumUniqueCustomTags, card, newRand().Int63()}
+		if err := tb.validate(); err != nil {
+			return err
+		}
+		w.builder = tb
+	default:
+		return fmt.Errorf("builder must be simple or tagged. got %q", w.Builder)
+	}
+
+	var err error
+	w.vg, err = NewValueGenerator(w.ValueModel, newRand())
+	if err != nil {
+		return err
+	}
+	w.profile, err = NewLoadProfile(w.LoadProfile)
+	if err != nil {
+		return err
+	}
+	w.churn, err = newChurner(w.ChurnPct, w.ChurnInterval)
+	if err != nil {
+		return err
+	}
+	w.dist, err = NewIntervalDistribution(w.IntervalDist, newRand().Int63())
+	if err != nil {
+		return err
+	}
+	if err := w.dist.check(int(w.Period.Seconds())); err != nil {
+		return err
+	}
+	w.faults, err = newFaultInjector(w.Faults, newRand())
+	if err != nil {
+		return err
+	}
+
+	names := w.Outputs
+	if len(names) == 0 {
+		for _, name := range outputNames {
+			if _, ok := outs[name]; ok {
+				names = append(names, name)
+			}
+		}
+	}
+	for _, name := range names {
+		o, ok := outs[name]
+		if !ok {
+			return fmt.Errorf("output %q is not configured", name)
+		}
+		if err := checkOrgs(name, w.Orgs); err != nil {
+			return err
+		}
+		w.outs = append(w.outs, o)
+	}
+	if len(w.outs) == 0 {
+		return errors.New("need to define an output")
+	}
+	return nil
+}
+
+// run runs the workload, until its duration has elapsed or the scenario ends
+func (w *Workload) run(scenario *runLimit) {
+	if w.Start > 0 {
+		log.Info("workload %s: starting in %s", w.Name, w.Start)
+		select {
+		case <-time.After(w.Start):
+		case <-scenario.Done():
+			return
+		}
+	}
+	lim := newRunLimit(w.Duration, 0)
+	go func() {
+		select {
+		case <-scenario.Done():
+			lim.stop(scenario.stopReason())
+		case <-lim.Done():
+		}
+	}()
+	log.Info("workload %s: starting", w.Name)
+	period := int(w.Period.Seconds())
+	flush := int(w.Flush.Nanoseconds() / 1000 / 1000)
+	err := dataFeed(w.Name, w.outs, w.Orgs, w.Mpo, period, flush, w.builder, w.vg, feedOptions{
+		offset:    int(w.Offset.Seconds()),
+		speedup:   w.Speedup,
+		stopAtNow: w.Offset > 0,
+		maxLag:    w.MaxLag,
+		profile:   w.profile,
+		churn:     w.churn,
+		dist:      &w.dist,
+		faults:    w.faults,
+	}, lim)
+	if err != nil {
+		log.Error(0, "workload %s: %s", w.Name, err)
+		return
+	}
+	log.Info("workload %s: done", w.Name)
+}
+
+// readWorkloads reads the workloads from the scenario, which has been merged into the viper config
+func readWorkloads() ([]Workload, error) {
+	var raw []map[string]interface{}
+	if err := viper.UnmarshalKey("workloads", &raw); err != nil {
+		return nil, err
+	}
+	if len(raw) == 0 {
+		return nil, errors.New("scenario has no workloads")
+	}
+	workloads := make([]Workload, len(raw))
+	seen := make(map[string]bool)
+	for i, r := range raw {
+		// decode each workload on top of the defaults
+		v := viper.New()
+		for key, val := range r {
+			v.Set(key, val)
+		}
+		workloads[i] = newWorkload()
+		if err := v.Unmarshal(&workloads[i]); err != nil {
+			return nil, fmt.Errorf("workload %d: %s", i, err)
+		}
+		if seen[workloads[i].Name] {
+			return nil, fmt.Errorf("workload %d: duplicate name %q", i, workloads[i].Name)
+		}
+		seen[workloads[i].Name] = true
+	}
+	return workloads, nil
+}
+
+var runCmd = &cobra.Command{
+	Use:   "run",
+	Short: "Runs the workloads declared in a scenario file concurrently",
+	Long: `Runs the workloads declared in a scenario file concurrently.
+The scenario file may set any of the global flags (e.g. kafka-mdm-addr) to configure the outputs,
+and declares the workloads under the 'workloads' key. Each workload supports:
+name, builder (simple|tagged), metricname, orgs, mpo, period, flush, offset, speedup, value-model,
+load-profile (flat|ramp|step|diurnal|burst, see feed --help), churn-pct, churn-interval,
+interval-distribution (fixed|mix|zipf, see feed --help), faults (see feed --help),
+add-tags, num-unique-tags, custom-tags, num-unique-custom-tags, tag-cardinality (see --help),
+outputs (list of carbon|gnet|kafka-mdm|kafka-mdam|influx|opentsdb|promrw|statsd|file|stdout, default all configured),
+start (delay before starting), duration (default forever) and max-lag (default none).`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if scenarioFile == "" {
+			log.Fatal(4, "a scenario file must be specified")
+		}
+		workloads, err := readWorkloads()
+		if err != nil {
+			log.Fatal(4, "invalid scenario %q: %s", scenarioFile, err)
+		}
+		initStats(true, "run")
+		lim := newRunLimit(0, 0)
+		lim.stopOnSignal()
+		// each workload checks whether the outputs it uses can simulate its number of orgs
+		outs := getNamedOutputs(1)
+		for i := range workloads {
+			if err := workloads[i].prepare(outs); err != nil {
+				log.Fatal(4, "invalid workload %q: %s", workloads[i].Name, err)
+			}
+		}
+
+		wg := &sync.WaitGroup{}
+		wg.Add(len(workloads))
+		for i := range workloads {
+			go func(w *Workload) {
+				w.run(lim)
+				wg.Done()
+			}(&workloads[i])
+		}
+		wg.Wait()
+		for _, o := range outs {
+			if err := o.Close(); err != nil {
+				log.Error(0, "failed to close output: %s", err)
+			}
+		}
+		finishRun(lim)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(runCmd)
+	runCmd.Flags().StringVar(&scenarioFile, "scenario", "", "scenario file (yaml) describing the workloads to run")
+}
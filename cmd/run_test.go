@@ -0,0 +1,83 @@
+package cmd
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/raintank/fakemetrics/out"
+	"github.com/spf13/viper"
+)
+
+func TestReadWorkloads(t *testing.T) {
+	defer viper.Reset()
+
+	cases := []struct {
+		scenario string
+		expErr   bool
+	}{
+		{"workloads: []", true},
+		{"workloads:\n- name: a\n- name: a\n", true},
+		{"workloads:\n- name: a\n  mpo: many\n", true},
+		{"workloads:\n- name: a\n- name: b\n  orgs: 3\n  period: 10s\n  outputs: [stdout]\n  custom-tags: [a, b]\n", false},
+	}
+	for _, c := range cases {
+		viper.Reset()
+		viper.SetConfigType("yaml")
+		if err := viper.ReadConfig(bytes.NewBufferString(c.scenario)); err != nil {
+			t.Fatal(err)
+		}
+		workloads, err := readWorkloads()
+		if c.expErr != (err != nil) {
+			t.Fatalf("scenario %q: expected error %t, got %v", c.scenario, c.expErr, err)
+		}
+		if err != nil {
+			continue
+		}
+		// unset settings have the defaults of the feed command
+		a, b := workloads[0], workloads[1]
+		if len(workloads) != 2 || a.Name != "a" || a.Orgs != 1 || a.Mpo != 100 || a.Period != time.Second || a.Builder != "tagged" {
+			t.Fatalf("scenario %q: unexpected first workload %+v", c.scenario, a)
+		}
+		if b.Name != "b" || b.Orgs != 3 || b.Mpo != 100 || b.Period != 10*time.Second || len(b.Outputs) != 1 || len(b.CustomTags) != 2 {
+			t.Fatalf("scenario %q: unexpected second workload %+v", c.scenario, b)
+		}
+	}
+}
+
+func TestWorkloadPrepare(t *testing.T) {
+	defer func(prefix string) { carbonOrgPrefix = prefix }(carbonOrgPrefix)
+	carbonOrgPrefix = ""
+	outs := map[string]out.Out{"carbon": &rawOut{}, "stdout": &rawOut{}}
+
+	cases := []struct {
+		desc   string
+		change func(w *Workload)
+		expErr bool
+	}{
+		{"defaults", func(w *Workload) {}, false},
+		{"no name", func(w *Workload) { w.Name = "" }, true},
+		{"period not whole seconds", func(w *Workload) { w.Period = 1500 * time.Millisecond }, true},
+		{"unknown builder", func(w *Workload) { w.Builder = "fancy" }, true},
+		{"invalid value model", func(w *Workload) { w.ValueModel = "sine:period=-1s" }, true},
+		{"invalid load profile", func(w *Workload) { w.LoadProfile = "wave" }, true},
+		{"invalid faults", func(w *Workload) { w.Faults = "drop=2" }, true},
+		{"output not configured", func(w *Workload) { w.Outputs = []string{"influx"} }, true},
+		// carbon can't simulate several orgs without {org} in its prefix
+		{"orgs of a workload using carbon", func(w *Workload) { w.Orgs = 2 }, true},
+		{"orgs of a workload not using carbon", func(w *Workload) { w.Orgs = 2; w.Outputs = []string{"stdout"} }, false},
+	}
+	for _, c := range cases {
+		w := newWorkload()
+		w.Name = "test"
+		c.change(&w)
+		err := w.prepare(outs)
+		if c.expErr != (err != nil) {
+			t.Errorf("%s: expected error %t, got %v", c.desc, c.expErr, err)
+			continue
+		}
+		if err == nil && len(w.outs) == 0 {
+			t.Errorf("%s: expected outputs to be set", c.desc)
+		}
+	}
+}
@@ -31,6 +31,7 @@ var schemasFile = "/etc/metrictank/storage-schemas.conf"
 
 func init() {
 	rootCmd.AddCommand(schemasbackfillCmd)
+	schemasbackfillCmd.Flags().StringVar(&valueModel, "value-model", "random", valueModelHelp)
 	schemasbackfillCmd.Flags().IntVar(&mpr, "mpr", 10, "how many metrics so simulate per rule")
 	schemasbackfillCmd.Flags().StringVar(&schemasFile, "schemas-file", "/etc/metrictank/storage-schemas.conf", "path to storage-schemas.conf file")
 	schemasbackfillCmd.Flags().StringVar(&ignore, "ignore", "default", "comma separated list of section names to exclude")
@@ -38,6 +39,8 @@ func init() {
 	schemasbackfillCmd.Flags().IntVar(&speedup, "speedup", 1, "for each advancement of real time, how many advancements of fake data to simulate")
 	schemasbackfillCmd.Flags().DurationVar(&flushDur, "flush", time.Second, "how often to flush metrics")
 	schemasbackfillCmd.Flags().DurationVar(&periodDur, "period", time.Second, "period between metric points (must be a multiple of 1s)")
+	schemasbackfillCmd.Flags().DurationVar(&runDuration, "duration", 0, "how long to run for. 0 to run until 'now' is reached or interrupted")
+	schemasbackfillCmd.Flags().Int64Var(&maxPoints, "max-points", 0, "stop after sending this many points, across all rules. 0 for no limit")
 }
 
 // schemasbackfillCmd represents the schemasbackfill command
@@ -60,7 +63,14 @@ var schemasbackfillCmd = &cobra.Command{
 		}
 		ignoreList := strings.Split(ignore, ",")
 
-		wg.Add(len(schemasList))
+		type job struct {
+			name   string
+			period int
+			vg     ValueGenerator
+		}
+		// set up all feeds before starting any, so that an invalid value model doesn't leave feeds running,
+		// and so that seeded runs are reproducible
+		var jobs []job
 		for _, schema := range schemasList {
 			if in(schema.Name, ignoreList) {
 				continue
@@ -76,12 +86,27 @@ var schemasbackfillCmd = &cobra.Command{
 			if name == "" {
 				name = "default"
 			}
-			go func(name string, period int) {
-				dataFeed(outs, 1, mpr, period, flush, int(offset.Seconds()), speedup, true, SimpleBuilder{name})
+			vg, err := NewValueGenerator(valueModel, newRand())
+			if err != nil {
+				log.Fatal(err.Error())
+			}
+			jobs = append(jobs, job{name, schema.Retentions.Rets[0].SecondsPerPoint, vg})
+		}
+		lim := newRunLimit(runDuration, maxPoints)
+		lim.stopOnSignal()
+		wg.Add(len(jobs))
+		for _, j := range jobs {
+			go func(j job) {
+				err := dataFeed(j.name, outs, 1, mpr, j.period, flush, SimpleBuilder{j.name}, j.vg, feedOptions{offset: int(offset.Seconds()), speedup: speedup, stopAtNow: true}, lim)
+				if err != nil {
+					log.Errorf("can't backfill %s: %s", j.name, err.Error())
+				}
 				wg.Done()
-			}(name, schema.Retentions.Rets[0].SecondsPerPoint)
+			}(j)
 		}
 		wg.Wait()
+		closeOutputs(outs)
+		finishRun(lim)
 	},
 }
 
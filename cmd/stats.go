@@ -2,9 +2,11 @@ package cmd
 
 import (
 	"github.com/raintank/worldping-api/pkg/log"
+	"net/http"
 	"os"
 	"strings"
 
+	"github.com/raintank/fakemetrics/promstats"
 	"github.com/raintank/met/helper"
 )
 
@@ -14,15 +16,38 @@ func initStats(enabled bool, service string) {
 		log.Fatal(4, "failed to lookup hostname. %s", err)
 	}
 	service = "fakemetrics." + service
-	if statsdAddr != "" && enabled {
-		stats, err = helper.New(true, statsdAddr, statsdType, service, strings.Replace(hostname, ".", "_", -1))
-	} else {
-		stats, err = helper.New(false, statsdAddr, statsdType, service, strings.Replace(hostname, ".", "_", -1))
-	}
-	if err != nil {
-		log.Fatal(4, "failed to initialize statsd. %s", err)
+	switch statsBackend {
+	case "statsd":
+		if statsdAddr != "" && enabled {
+			stats, err = helper.New(true, statsdAddr, statsdType, service, strings.Replace(hostname, ".", "_", -1))
+		} else {
+			stats, err = helper.New(false, statsdAddr, statsdType, service, strings.Replace(hostname, ".", "_", -1))
+		}
+		if err != nil {
+			log.Fatal(4, "failed to initialize statsd. %s", err)
+		}
+	case "prometheus":
+		if listenAddr == "" {
+			log.Fatal(4, "the prometheus stats backend needs the listener to be enabled")
+		}
+		prom := promstats.New()
+		http.Handle("/metrics", prom)
+		stats = prom
+	default:
+		log.Fatal(4, "invalid stats backend %q. must be statsd or prometheus", statsBackend)
 	}
 
+	// keep track of all stats in-process as well, for the report at the end of the run
+	recorded = newRecorder(stats)
+	stats = recorded
+
 	flushDuration = stats.NewTimer("metricpublisher.global.flush_duration", 0)
+	pointsGenerated = stats.NewCount("metricpublisher.global.points_generated")
+	behindTicks = stats.NewCount("metricpublisher.global.behind_ticks")
+	missedTicks = stats.NewGauge("metricpublisher.global.missed_ticks", 0)
+	lagMs = stats.NewGauge("metricpublisher.global.lag_ms", 0)
+	seriesActive = stats.NewGauge("metricpublisher.global.series_active", 0)
+	seriesCreated = stats.NewCount("metricpublisher.global.series_created")
+	faultStats = newFaultCounters(stats)
 
 }
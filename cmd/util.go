@@ -15,61 +15,100 @@
 package cmd
 
 import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/raintank/worldping-api/pkg/log"
 
 	"github.com/raintank/fakemetrics/out"
 	"github.com/raintank/fakemetrics/out/carbon"
+	"github.com/raintank/fakemetrics/out/file"
 	"github.com/raintank/fakemetrics/out/gnet"
+	"github.com/raintank/fakemetrics/out/influx"
 	"github.com/raintank/fakemetrics/out/kafkamdam"
 	"github.com/raintank/fakemetrics/out/kafkamdm"
+	"github.com/raintank/fakemetrics/out/opentsdb"
+	"github.com/raintank/fakemetrics/out/promrw"
+	"github.com/raintank/fakemetrics/out/statsd"
 	"github.com/raintank/fakemetrics/out/stdout"
 )
 
 func checkOutputs() {
-	if carbonAddr == "" && gnetAddr == "" && kafkaMdmAddr == "" && kafkaMdamAddr == "" && !stdoutOut {
-		log.Fatal(4, "must use at least either carbon, gnet, kafka-mdm, kafka-mdam or stdout")
+	if carbonAddr == "" && gnetAddr == "" && kafkaMdmAddr == "" && kafkaMdamAddr == "" && influxAddr == "" && opentsdbAddr == "" && promrwAddr == "" && statsdOutAddr == "" && fileOut == "" && !stdoutOut {
+		log.Fatal(4, "must use at least either carbon, gnet, kafka-mdm, kafka-mdam, influx, opentsdb, promrw, statsd, file or stdout")
 	}
 }
 
+// outputNames lists all outputs, in the order in which getOutputs creates them
+var outputNames = []string{"carbon", "gnet", "kafka-mdm", "kafka-mdam", "influx", "opentsdb", "promrw", "statsd", "file", "stdout"}
+
 func getOutputs() []out.Out {
 	var outs []out.Out
+	named := getNamedOutputs(orgs)
+	for _, name := range outputNames {
+		if o, ok := named[name]; ok {
+			outs = append(outs, o)
+		}
+	}
+	return outs
+}
+
+// closeOutputs closes all outputs, which makes them send out any data they still hold
+func closeOutputs(outs []out.Out) {
+	for _, o := range outs {
+		if err := o.Close(); err != nil {
+			log.Error(0, "failed to close output: %s", err)
+		}
+	}
+}
+
+// getNamedOutputs creates all configured outputs, keyed by their name.
+// orgs is the number of orgs that the outputs must be able to simulate.
+func getNamedOutputs(orgs int) map[string]out.Out {
+	outs := make(map[string]out.Out)
 
 	if carbonAddr != "" {
-		if orgs > 1 {
-			log.Fatal(4, "can only simulate 1 org when using carbon output")
+		if err := checkOrgs("carbon", orgs); err != nil {
+			log.Fatal(4, "%s", err)
 		}
-		o, err := carbon.New(carbonAddr, stats)
+		o, err := carbon.New(carbonAddr, carbonTags, carbonOrgPrefix, carbonProto, carbonTransport, carbonMaxBytes, carbonMTU, stats)
 		if err != nil {
 			log.Fatal(4, "failed to create carbon output. %s", err)
 		}
-		outs = append(outs, o)
+		outs["carbon"] = o
 	}
 
 	if gnetAddr != "" {
-		if orgs > 1 {
-			log.Fatal(4, "can only simulate 1 org when using gnet output")
+		if err := checkOrgs("gnet", orgs); err != nil {
+			log.Fatal(4, "%s", err)
 		}
-		if gnetKey == "" {
-			log.Fatal(4, "to use gnet, a key must be specified")
+		keys, err := gnetKeys()
+		if err != nil {
+			log.Fatal(4, "%s", err)
 		}
-		o, err := gnet.New(gnetAddr, gnetKey, stats)
+		o, err := gnet.New(gnetAddr, keys, stats)
 		if err != nil {
 			log.Fatal(4, "failed to create gnet output. %s", err)
 		}
-		outs = append(outs, o)
+		outs["gnet"] = o
 	}
 
 	if kafkaMdmAddr != "" {
 		if kafkaMdmTopic == "" {
 			log.Fatal(4, "kafka-mdm needs the topic to be set")
 		}
-		o, err := kafkamdm.New(kafkaMdmTopic, []string{kafkaMdmAddr}, kafkaCompression, 30*time.Second, stats, partitionScheme, kafkaMdmV2)
+		if err := checkOrgs("kafka-mdm", orgs); err != nil {
+			log.Fatal(4, "%s", err)
+		}
+		o, err := kafkamdm.New(kafkaMdmTopic, []string{kafkaMdmAddr}, kafkaCompression, 30*time.Second, stats, partitionScheme, kafkaMdmWireFormat(kafkaMdmFormat, kafkaMdmV2))
 		if err != nil {
 			log.Fatal(4, "failed to create kafka-mdm output. %s", err)
 		}
-		outs = append(outs, o)
+		outs["kafka-mdm"] = o
 	}
 
 	if kafkaMdamAddr != "" {
@@ -77,12 +116,142 @@ func getOutputs() []out.Out {
 		if err != nil {
 			log.Fatal(4, "failed to create kafka-mdam output. %s", err)
 		}
-		outs = append(outs, o)
+		outs["kafka-mdam"] = o
+	}
+
+	if influxAddr != "" {
+		if influxBatch < 1 {
+			log.Fatal(4, "influx-batch must be at least 1")
+		}
+		o, err := influx.New(influxAddr, influxPrecision, influxBatch, influxNodes, stats)
+		if err != nil {
+			log.Fatal(4, "failed to create influx output. %s", err)
+		}
+		outs["influx"] = o
+	}
+
+	if opentsdbAddr != "" {
+		if opentsdbBatch < 1 {
+			log.Fatal(4, "opentsdb-batch must be at least 1")
+		}
+		o, err := opentsdb.New(opentsdbAddr, opentsdbOrgTag, opentsdbBatch, stats)
+		if err != nil {
+			log.Fatal(4, "failed to create opentsdb output. %s", err)
+		}
+		outs["opentsdb"] = o
+	}
+
+	if promrwAddr != "" {
+		if promrwBatch < 1 {
+			log.Fatal(4, "promrw-batch must be at least 1")
+		}
+		o, err := promrw.New(promrwAddr, promrwBatch, stats)
+		if err != nil {
+			log.Fatal(4, "failed to create promrw output. %s", err)
+		}
+		outs["promrw"] = o
+	}
+
+	if statsdOutAddr != "" {
+		o, err := statsd.New(statsdOutAddr, statsdOutType, statsdOutPacket, stats)
+		if err != nil {
+			log.Fatal(4, "failed to create statsd output. %s", err)
+		}
+		outs["statsd"] = o
+	}
+
+	if fileOut != "" {
+		o, err := file.New(fileOut, fileFormat, fileGzip, stats)
+		if err != nil {
+			log.Fatal(4, "failed to create file output. %s", err)
+		}
+		outs["file"] = o
 	}
 
 	if stdoutOut {
-		outs = append(outs, stdout.New(stats))
+		outs["stdout"] = stdout.New(stats)
 	}
 
 	return outs
 }
+
+// kafkaMdmWireFormat returns the kafka-mdm format to use: the given one,
+// or if none is given, metricpoint or metricdata, depending on whether v2 is enabled
+func kafkaMdmWireFormat(format string, v2 bool) string {
+	if format != "" {
+		return format
+	}
+	if v2 {
+		return "metricpoint"
+	}
+	return "metricdata"
+}
+
+// checkOrgs checks whether the given output is configured to be able to simulate the given number of orgs
+func checkOrgs(output string, orgs int) error {
+	switch output {
+	case "carbon":
+		if orgs > 1 && !strings.Contains(carbonOrgPrefix, "{org}") {
+			return errors.New("to simulate more than 1 org with carbon output, carbon-org-prefix must contain {org}")
+		}
+	case "gnet":
+		if orgs > 1 && gnetKeyFile == "" && !strings.Contains(gnetKey, "{org}") {
+			return errors.New("to simulate more than 1 org with gnet output, gnet-key must contain {org} or gnet-key-file must be used")
+		}
+		keys, err := gnetKeys()
+		if err != nil {
+			return err
+		}
+		for org := 1; org <= orgs; org++ {
+			if _, err := keys(org); err != nil {
+				return err
+			}
+		}
+	case "kafka-mdm":
+		if err := kafkamdm.CheckFormat(kafkaMdmWireFormat(kafkaMdmFormat, kafkaMdmV2), orgs); err != nil {
+			return fmt.Errorf("kafka-mdm-format: %s", err)
+		}
+	}
+	return nil
+}
+
+// gnetKeys returns the function that provides the gnet api key for each org,
+// based on the gnet-key template or the gnet-key-file
+func gnetKeys() (gnet.KeyFunc, error) {
+	if gnetKeyFile == "" {
+		if gnetKey == "" {
+			return nil, errors.New("to use gnet, a key or key file must be specified")
+		}
+		return func(org int) (string, error) {
+			return strings.Replace(gnetKey, "{org}", strconv.Itoa(org), -1), nil
+		}, nil
+	}
+
+	data, err := ioutil.ReadFile(gnetKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("can't read gnet key file: %s", err)
+	}
+	keys := make(map[int]string)
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("gnet key file line %d: expected 'orgid key'", i+1)
+		}
+		org, err := strconv.Atoi(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("gnet key file line %d: invalid orgid %q", i+1, fields[0])
+		}
+		keys[org] = fields[1]
+	}
+	return func(org int) (string, error) {
+		key, ok := keys[org]
+		if !ok {
+			return "", fmt.Errorf("gnet key file has no key for org %d", org)
+		}
+		return key, nil
+	}, nil
+}
@@ -0,0 +1,34 @@
+package cmd
+
+import "testing"
+
+func TestKafkaMdmFormat(t *testing.T) {
+	defer func(format string, v2 bool) { kafkaMdmFormat, kafkaMdmV2 = format, v2 }(kafkaMdmFormat, kafkaMdmV2)
+
+	cases := []struct {
+		format    string
+		v2        bool
+		orgs      int
+		expFormat string
+		expErr    bool
+	}{
+		{"", true, 1, "metricpoint", false},
+		{"", false, 1, "metricdata", false},
+		{"", false, 10, "metricdata", false},
+		{"auto", false, 10, "auto", false},
+		{"metricdata", true, 1, "metricdata", false},
+		{"metricpoint-without-org", true, 1, "metricpoint-without-org", false},
+		{"metricpoint-without-org", true, 2, "metricpoint-without-org", true},
+		{"metricpoint-v3", true, 1, "metricpoint-v3", true},
+	}
+	for _, c := range cases {
+		if got := kafkaMdmWireFormat(c.format, c.v2); got != c.expFormat {
+			t.Errorf("format %q with v2 %t: expected %q, got %q", c.format, c.v2, c.expFormat, got)
+		}
+		kafkaMdmFormat, kafkaMdmV2 = c.format, c.v2
+		err := checkOrgs("kafka-mdm", c.orgs)
+		if c.expErr != (err != nil) {
+			t.Errorf("format %q with v2 %t and %d orgs: expected error %t, got %v", c.format, c.v2, c.orgs, c.expErr, err)
+		}
+	}
+}
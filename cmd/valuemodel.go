@@ -0,0 +1,303 @@
+package cmd
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const valueModelHelp = "how to generate values. one of random|constant|sine|counter|randomwalk|square|sawtooth, optionally followed by ':' and comma separated key=value params. e.g. 'sine:period=1h,amplitude=50'"
+
+// ValueGenerator generates the values of the points of a workload
+type ValueGenerator interface {
+	Info() string
+	// Value returns the value for series m of org o at timestamp ts (in seconds)
+	// it is called for every point of every series, in timestamp order per series
+	Value(o, m int, ts int64) float64
+}
+
+// seriesState tracks a float64 of state for each series of each org,
+// for value generators that need to remember where each series left off
+type seriesState [][]float64
+
+func (s *seriesState) get(o, m int) *float64 {
+	for len(*s) <= o {
+		*s = append(*s, nil)
+	}
+	for len((*s)[o]) <= m {
+		(*s)[o] = append((*s)[o], 0)
+	}
+	return &(*s)[o][m]
+}
+
+// RandomValues generates a random value between 0 and m+1
+// this is the traditional fakemetrics behavior
+type RandomValues struct {
+	rng *rand.Rand
+}
+
+func (r RandomValues) Info() string {
+	return "random"
+}
+
+func (r RandomValues) Value(o, m int, ts int64) float64 {
+	return r.rng.Float64() * float64(m+1)
+}
+
+// ConstantValues always generates the same value
+type ConstantValues struct {
+	value float64
+}
+
+func (c ConstantValues) Info() string {
+	return fmt.Sprintf("constant:value=%g", c.value)
+}
+
+func (c ConstantValues) Value(o, m int, ts int64) float64 {
+	return c.value
+}
+
+// SineValues generates a sine wave oscillating around offset
+type SineValues struct {
+	period    int64 // in seconds
+	amplitude float64
+	offset    float64
+}
+
+func (s SineValues) Info() string {
+	return fmt.Sprintf("sine:period=%ds,amplitude=%g,offset=%g", s.period, s.amplitude, s.offset)
+}
+
+func (s SineValues) Value(o, m int, ts int64) float64 {
+	return s.offset + s.amplitude*math.Sin(2*math.Pi*float64(ts%s.period)/float64(s.period))
+}
+
+// CounterValues generates monotonically increasing values,
+// which fall back to 0 once they exceed reset (if set)
+type CounterValues struct {
+	increment float64
+	reset     float64
+	state     seriesState
+}
+
+func (c *CounterValues) Info() string {
+	return fmt.Sprintf("counter:increment=%g,reset=%g", c.increment, c.reset)
+}
+
+func (c *CounterValues) Value(o, m int, ts int64) float64 {
+	v := c.state.get(o, m)
+	*v += c.increment
+	if c.reset > 0 && *v > c.reset {
+		*v = 0
+	}
+	return *v
+}
+
+// RandomWalkValues generates values that each differ from the previous one
+// by a random amount between -step and +step
+type RandomWalkValues struct {
+	step  float64
+	state seriesState
+	rng   *rand.Rand
+}
+
+func (r *RandomWalkValues) Info() string {
+	return fmt.Sprintf("randomwalk:step=%g", r.step)
+}
+
+func (r *RandomWalkValues) Value(o, m int, ts int64) float64 {
+	v := r.state.get(o, m)
+	*v += (r.rng.Float64()*2 - 1) * r.step
+	return *v
+}
+
+// SquareValues alternates between low and high each half period
+type SquareValues struct {
+	period int64 // in seconds
+	low    float64
+	high   float64
+}
+
+func (s SquareValues) Info() string {
+	return fmt.Sprintf("square:period=%ds,low=%g,high=%g", s.period, s.low, s.high)
+}
+
+func (s SquareValues) Value(o, m int, ts int64) float64 {
+	if ts%s.period < s.period/2 {
+		return s.high
+	}
+	return s.low
+}
+
+// SawtoothValues rises linearly from 0 to amplitude over each period
+type SawtoothValues struct {
+	period    int64 // in seconds
+	amplitude float64
+}
+
+func (s SawtoothValues) Info() string {
+	return fmt.Sprintf("sawtooth:period=%ds,amplitude=%g", s.period, s.amplitude)
+}
+
+func (s SawtoothValues) Value(o, m int, ts int64) float64 {
+	return s.amplitude * float64(ts%s.period) / float64(s.period)
+}
+
+// specParams holds the key=value params of a spec such as 'sine:period=1h,amplitude=50'
+type specParams map[string]string
+
+// parseSpec splits a spec into its name and params
+func parseSpec(spec string) (string, specParams, error) {
+	pos := strings.Index(spec, ":")
+	if pos < 0 {
+		return spec, make(specParams), nil
+	}
+	params, err := parseParams(spec[pos+1:])
+	return spec[:pos], params, err
+}
+
+// parseParams parses comma separated key=value params
+func parseParams(s string) (specParams, error) {
+	params := make(specParams)
+	for _, kv := range strings.Split(s, ",") {
+		if kv == "" {
+			continue
+		}
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("param %q must be of the form key=value", kv)
+		}
+		params[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+	}
+	return params, nil
+}
+
+// unknown returns an error listing the params that were not consumed
+func (p specParams) unknown() error {
+	if len(p) == 0 {
+		return nil
+	}
+	var unknown []string
+	for k := range p {
+		unknown = append(unknown, k)
+	}
+	sort.Strings(unknown)
+	return fmt.Errorf("unknown params %s", strings.Join(unknown, ","))
+}
+
+func (p specParams) float(key string, def float64) (float64, error) {
+	s, ok := p[key]
+	if !ok {
+		return def, nil
+	}
+	delete(p, key)
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid value %q for param %q: %s", s, key, err)
+	}
+	return v, nil
+}
+
+// period parses a duration param into a number of seconds
+func (p specParams) period(key string, def time.Duration) (int64, error) {
+	s, ok := p[key]
+	if ok {
+		delete(p, key)
+		var err error
+		def, err = time.ParseDuration(s)
+		if err != nil {
+			return 0, fmt.Errorf("invalid value %q for param %q: %s", s, key, err)
+		}
+	}
+	if def < time.Second || def%time.Second != 0 {
+		return 0, fmt.Errorf("param %q must be a multiple of 1s", key)
+	}
+	return int64(def.Seconds()), nil
+}
+
+// duration parses a duration param, which must be positive
+func (p specParams) duration(key string, def time.Duration) (time.Duration, error) {
+	s, ok := p[key]
+	if ok {
+		delete(p, key)
+		var err error
+		def, err = time.ParseDuration(s)
+		if err != nil {
+			return 0, fmt.Errorf("invalid value %q for param %q: %s", s, key, err)
+		}
+	}
+	if def <= 0 {
+		return 0, fmt.Errorf("param %q must be positive", key)
+	}
+	return def, nil
+}
+
+// NewValueGenerator creates a ValueGenerator from a spec such as 'sine:period=1h,amplitude=50'
+// every call returns a new generator, with its own state. random values are drawn from rng.
+func NewValueGenerator(spec string, rng *rand.Rand) (ValueGenerator, error) {
+	model, params, err := parseSpec(spec)
+	if err != nil {
+		return nil, fmt.Errorf("value model %q: %s", model, err)
+	}
+
+	var vg ValueGenerator
+	switch model {
+	case "random":
+		vg = RandomValues{rng}
+	case "constant":
+		var c ConstantValues
+		c.value, err = params.float("value", 1)
+		vg = c
+	case "sine":
+		s := SineValues{}
+		if s.period, err = params.period("period", time.Hour); err != nil {
+			break
+		}
+		if s.amplitude, err = params.float("amplitude", 100); err != nil {
+			break
+		}
+		s.offset, err = params.float("offset", 0)
+		vg = s
+	case "counter":
+		c := &CounterValues{}
+		if c.increment, err = params.float("increment", 1); err != nil {
+			break
+		}
+		c.reset, err = params.float("reset", 0)
+		vg = c
+	case "randomwalk":
+		r := &RandomWalkValues{rng: rng}
+		r.step, err = params.float("step", 1)
+		vg = r
+	case "square":
+		s := SquareValues{}
+		if s.period, err = params.period("period", time.Minute); err != nil {
+			break
+		}
+		if s.low, err = params.float("low", 0); err != nil {
+			break
+		}
+		s.high, err = params.float("high", 1)
+		vg = s
+	case "sawtooth":
+		s := SawtoothValues{}
+		if s.period, err = params.period("period", time.Minute); err != nil {
+			break
+		}
+		s.amplitude, err = params.float("amplitude", 100)
+		vg = s
+	default:
+		return nil, fmt.Errorf("unknown value model %q", model)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("value model %q: %s", model, err)
+	}
+	if err := params.unknown(); err != nil {
+		return nil, fmt.Errorf("value model %q: %s", model, err)
+	}
+	return vg, nil
+}
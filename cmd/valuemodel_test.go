@@ -0,0 +1,85 @@
+package cmd
+
+import (
+	"math/rand"
+	"testing"
+)
+
+func TestNewValueGenerator(t *testing.T) {
+	cases := []struct {
+		spec    string
+		expInfo string
+		expErr  bool
+	}{
+		{"random", "random", false},
+		{"constant", "constant:value=1", false},
+		{"constant:value=42.5", "constant:value=42.5", false},
+		{"sine:period=10m,amplitude=5", "sine:period=600s,amplitude=5,offset=0", false},
+		{"counter:reset=100", "counter:increment=1,reset=100", false},
+		{"square:period=1500ms", "", true},
+		{"sawtooth:foo=bar", "", true},
+		{"constant:value", "", true},
+		{"constant:value=abc", "", true},
+		{"unknown", "", true},
+	}
+	for _, c := range cases {
+		vg, err := NewValueGenerator(c.spec, rand.New(rand.NewSource(1)))
+		if c.expErr {
+			if err == nil {
+				t.Errorf("spec %q: expected error, got none", c.spec)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("spec %q: expected no error, got %s", c.spec, err)
+			continue
+		}
+		if vg.Info() != c.expInfo {
+			t.Errorf("spec %q: expected info %q, got %q", c.spec, c.expInfo, vg.Info())
+		}
+	}
+}
+
+func TestCounterValuesReset(t *testing.T) {
+	vg, err := NewValueGenerator("counter:increment=2,reset=5", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := []float64{2, 4, 0, 2, 4, 0}
+	for i, e := range exp {
+		// interleave another series, which should not affect the first one
+		vg.Value(1, 3, int64(i))
+		if v := vg.Value(0, 0, int64(i)); v != e {
+			t.Fatalf("point %d: expected %f, got %f", i, e, v)
+		}
+	}
+}
+
+func TestSquareValues(t *testing.T) {
+	vg, err := NewValueGenerator("square:period=10s,low=1,high=3", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for ts := int64(100); ts < 120; ts++ {
+		exp := 1.0
+		if ts%10 < 5 {
+			exp = 3
+		}
+		if v := vg.Value(0, 0, ts); v != exp {
+			t.Fatalf("ts %d: expected %f, got %f", ts, exp, v)
+		}
+	}
+}
+
+func TestSeededValues(t *testing.T) {
+	for _, spec := range []string{"random", "randomwalk"} {
+		a, _ := NewValueGenerator(spec, rand.New(rand.NewSource(42)))
+		b, _ := NewValueGenerator(spec, rand.New(rand.NewSource(42)))
+		for ts := int64(0); ts < 100; ts++ {
+			m := int(ts % 7)
+			if va, vb := a.Value(0, m, ts), b.Value(0, m, ts); va != vb {
+				t.Fatalf("%s: ts %d: expected the same value with the same seed, got %f and %f", spec, ts, va, vb)
+			}
+		}
+	}
+}
@@ -2,52 +2,115 @@ package carbon
 
 import (
 	"bytes"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"net"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/grafana/metrictank/schema"
+	"github.com/jpillora/backoff"
 	"github.com/raintank/fakemetrics/out"
 	"github.com/raintank/met"
+	"github.com/raintank/worldping-api/pkg/log"
 )
 
 var errClosed = errors.New("output is closed")
 
+// udpHeaderSize is the size of the IP and UDP headers, which must fit in the MTU together with our payload
+const udpHeaderSize = 28
+
+// Carbon sends metrics using the carbon plaintext or pickle protocol, over tcp or udp.
+// when a tcp connection breaks, it reconnects in the background while buffering
+// up to maxPending bytes of data. anything beyond that is dropped.
+// the plaintext protocol has no NaN or infinite values, so with plain, such points are skipped and counted.
 type Carbon struct {
 	sync.Mutex
 	out.OutStats
-	addr   string
-	conn   net.Conn
-	closed bool
+	addr       string
+	tagged     bool   // whether to emit tags using the graphite 1.1 tagged series syntax
+	orgPrefix  string // prefix for names, in which {org} is replaced by the org id
+	proto      string // plain or pickle
+	transport  string // tcp or udp
+	maxBytes   int    // max size of a message. for udp this is the max datagram payload. 0 means unlimited
+	conn       net.Conn
+	closed     bool
+	pending    []byte // data we couldn't send yet while disconnected
+	maxPending int
+	nonFinite  met.Count // points not sent, because the plaintext protocol can't represent their NaN or infinite value
+}
+
+// message is a chunk of data to be written in one go, and the number of metrics it contains
+type message struct {
+	data []byte
+	num  int
 }
 
-func New(addr string, stats met.Backend) (*Carbon, error) {
-	conn, err := net.Dial("tcp", addr)
+// New creates a carbon output.
+// orgPrefix is prepended to each name, with {org} replaced by the org id of the metric.
+// for pickle, maxBytes limits the size of each pickle message.
+// for udp, datagrams are kept within the given mtu.
+func New(addr string, tagged bool, orgPrefix, proto, transport string, maxBytes, mtu int, stats met.Backend) (*Carbon, error) {
+	switch proto {
+	case "plain":
+		maxBytes = 0
+	case "pickle":
+		if transport == "udp" {
+			return nil, errors.New("the pickle protocol is not supported over udp")
+		}
+		if maxBytes < pickleOverhead {
+			return nil, fmt.Errorf("max bytes must be at least %d", pickleOverhead)
+		}
+	default:
+		return nil, fmt.Errorf("unknown protocol %q. must be plain or pickle", proto)
+	}
+	switch transport {
+	case "tcp":
+	case "udp":
+		if mtu <= udpHeaderSize {
+			return nil, fmt.Errorf("mtu must be more than %d", udpHeaderSize)
+		}
+		maxBytes = mtu - udpHeaderSize
+	default:
+		return nil, fmt.Errorf("unknown transport %q. must be tcp or udp", transport)
+	}
+
+	conn, err := net.Dial(transport, addr)
 	if err != nil {
 		return nil, err
 	}
 
 	return &Carbon{
-		sync.Mutex{},
-		out.NewStats(stats, "carbon"),
-		addr,
-		conn,
-		false,
+		OutStats:   out.NewStats(stats, "carbon"),
+		addr:       addr,
+		tagged:     tagged,
+		orgPrefix:  orgPrefix,
+		proto:      proto,
+		transport:  transport,
+		maxBytes:   maxBytes,
+		conn:       conn,
+		maxPending: 10 * 1024 * 1024,
+		nonFinite:  stats.NewCount("metricpublisher.out.carbon.non_finite_skipped"),
 	}, nil
 }
 
 func (n *Carbon) Close() error {
 	n.Lock()
+	defer n.Unlock()
 	if n.closed {
-		n.Unlock()
 		return nil
 	}
-	err := n.conn.Close()
 	n.closed = true
-	n.Unlock()
-	return err
+	if n.conn == nil {
+		return nil
+	}
+	if len(n.pending) > 0 {
+		n.conn.Write(n.pending)
+	}
+	return n.conn.Close()
 }
 
 func (n *Carbon) Flush(metrics []*schema.MetricData) error {
@@ -55,27 +118,230 @@ func (n *Carbon) Flush(metrics []*schema.MetricData) error {
 		n.FlushDuration.Value(0)
 		return nil
 	}
+	preFlush := time.Now()
+	if n.proto == "plain" {
+		metrics = out.SkipNonFinite(metrics, n.nonFinite)
+	}
+	msgs := n.encode(metrics)
+	if n.transport == "udp" {
+		return n.flushUDP(msgs, preFlush)
+	}
+	var data []byte
+	for _, msg := range msgs {
+		data = append(data, msg.data...)
+	}
 	n.Lock()
 	if n.closed {
+		n.Unlock()
 		return errClosed
 	}
-	preFlush := time.Now()
-	buf := bytes.NewBufferString("")
-	for _, m := range metrics {
-		buf.WriteString(fmt.Sprintf("%s %f %d\n", m.Name, m.Value, m.Time))
+	if n.conn == nil {
+		n.buffer(data)
+		n.Unlock()
+		n.FlushDuration.Value(time.Since(preFlush))
+		return nil
+	}
+	if len(n.pending) > 0 {
+		data = append(n.pending, data...)
+		n.pending = nil
 	}
 	prePub := time.Now()
-	_, err := n.conn.Write(buf.Bytes())
-	n.Unlock()
+	written, err := n.conn.Write(data)
 	if err != nil {
 		n.PublishErrors.Inc(1)
+		log.Warn("carbon write to %s failed: %s. reconnecting", n.addr, err)
+		n.conn.Close()
+		n.conn = nil
+		n.buffer(n.unsent(data, written))
+		go n.reconnect()
+		n.Unlock()
 		return err
 	}
-	n.MessageBytes.Value(int64(buf.Len()))
-	n.MessageMetrics.Value(int64(len(metrics)))
+	n.Unlock()
+	for _, msg := range msgs {
+		n.MessageBytes.Value(int64(len(msg.data)))
+		n.MessageMetrics.Value(int64(msg.num))
+	}
 	n.PublishedMetrics.Inc(int64(len(metrics)))
-	n.PublishedMessages.Inc(1)
+	n.PublishedMessages.Inc(int64(len(msgs)))
 	n.PublishDuration.Value(time.Since(prePub))
 	n.FlushDuration.Value(time.Since(preFlush))
 	return nil
 }
+
+// flushUDP sends each message as a datagram.
+// there is no buffering or reconnecting for udp: failed writes are lost
+func (n *Carbon) flushUDP(msgs []message, preFlush time.Time) error {
+	n.Lock()
+	defer n.Unlock()
+	if n.closed {
+		return errClosed
+	}
+	var firstErr error
+	prePub := time.Now()
+	for _, msg := range msgs {
+		_, err := n.conn.Write(msg.data)
+		if err != nil {
+			n.PublishErrors.Inc(1)
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		n.MessageBytes.Value(int64(len(msg.data)))
+		n.MessageMetrics.Value(int64(msg.num))
+		n.PublishedMetrics.Inc(int64(msg.num))
+		n.PublishedMessages.Inc(1)
+	}
+	n.PublishDuration.Value(time.Since(prePub))
+	n.FlushDuration.Value(time.Since(preFlush))
+	return firstErr
+}
+
+// encode encodes the metrics into messages of at most maxBytes (if set).
+// a single metric that exceeds maxBytes by itself gets its own message.
+func (n *Carbon) encode(metrics []*schema.MetricData) []message {
+	var msgs []message
+	var cur, item []byte
+	var num int
+	overhead := 0
+	if n.proto == "pickle" {
+		overhead = pickleOverhead
+	}
+	emit := func() {
+		if num == 0 {
+			return
+		}
+		if n.proto == "pickle" {
+			cur = pickleMessage(cur)
+		}
+		msgs = append(msgs, message{cur, num})
+		cur, num = nil, 0
+	}
+	for _, m := range metrics {
+		name := n.name(m)
+		if n.proto == "pickle" {
+			item = appendPickleItem(item[:0], name, m.Time, m.Value)
+		} else {
+			item = appendPlain(item[:0], name, m.Time, m.Value)
+		}
+		if n.maxBytes > 0 && num > 0 && overhead+len(cur)+len(item) > n.maxBytes {
+			emit()
+		}
+		cur = append(cur, item...)
+		num++
+	}
+	emit()
+	return msgs
+}
+
+// name returns the name of the metric to send, including the org prefix,
+// and optionally the tags as in name;tag=value;tag2=value2
+func (n *Carbon) name(m *schema.MetricData) string {
+	name := m.Name
+	if n.orgPrefix != "" {
+		name = strings.Replace(n.orgPrefix, "{org}", strconv.Itoa(m.OrgId), -1) + name
+	}
+	if !n.tagged || len(m.Tags) == 0 {
+		return name
+	}
+	var b strings.Builder
+	b.WriteString(name)
+	for _, tag := range m.Tags {
+		if !strings.Contains(tag, "=") || strings.HasPrefix(tag, "name=") {
+			continue
+		}
+		b.WriteByte(';')
+		b.WriteString(tag)
+	}
+	return b.String()
+}
+
+// appendPlain appends the metric in the carbon plaintext format
+func appendPlain(b []byte, name string, ts int64, value float64) []byte {
+	b = append(b, name...)
+	b = append(b, ' ')
+	b = strconv.AppendFloat(b, value, 'f', 6, 64)
+	b = append(b, ' ')
+	b = strconv.AppendInt(b, ts, 10)
+	return append(b, '\n')
+}
+
+// unsent returns the data that must be sent again on a new connection, after only the first
+// written bytes were written: everything from the start of the first message that was not
+// written completely. the new connection must start at a message boundary, or the receiver would
+// see a broken line, or for pickle, lose track of the framing. data must consist of whole messages.
+func (n *Carbon) unsent(data []byte, written int) []byte {
+	pos := 0
+	if n.proto == "pickle" {
+		// each message has a 4 byte length header
+		for pos+4 <= written {
+			end := pos + 4 + int(binary.BigEndian.Uint32(data[pos:]))
+			if end > written {
+				break
+			}
+			pos = end
+		}
+	} else {
+		pos = bytes.LastIndexByte(data[:written], '\n') + 1
+	}
+	return data[pos:]
+}
+
+// buffer adds data to the pending buffer, dropping it if the buffer is full.
+// caller must hold the lock
+func (n *Carbon) buffer(data []byte) {
+	if len(n.pending)+len(data) > n.maxPending {
+		n.PublishErrors.Inc(1)
+		log.Warn("carbon not connected to %s and buffer full. dropping %d bytes", n.addr, len(data))
+		return
+	}
+	n.pending = append(n.pending, data...)
+}
+
+// reconnect keeps trying to establish a new connection, and sends the pending data once connected
+func (n *Carbon) reconnect() {
+	b := &backoff.Backoff{
+		Min:    100 * time.Millisecond,
+		Max:    time.Minute,
+		Factor: 1.5,
+		Jitter: true,
+	}
+	for {
+		n.Lock()
+		closed := n.closed
+		n.Unlock()
+		if closed {
+			return
+		}
+		conn, err := net.Dial("tcp", n.addr)
+		if err != nil {
+			dur := b.Duration()
+			log.Warn("carbon failed to connect to %s: %s will try again in %s", n.addr, err, dur)
+			time.Sleep(dur)
+			continue
+		}
+		n.Lock()
+		if n.closed {
+			n.Unlock()
+			conn.Close()
+			return
+		}
+		n.Reconnects.Inc(1)
+		log.Info("carbon reconnected to %s", n.addr)
+		if len(n.pending) > 0 {
+			if written, err := conn.Write(n.pending); err != nil {
+				n.PublishErrors.Inc(1)
+				n.pending = n.unsent(n.pending, written)
+				n.Unlock()
+				conn.Close()
+				time.Sleep(b.Duration())
+				continue
+			}
+			n.pending = nil
+		}
+		n.conn = conn
+		n.Unlock()
+		return
+	}
+}
@@ -0,0 +1,147 @@
+package carbon
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/grafana/metrictank/schema"
+	"github.com/raintank/fakemetrics/promstats"
+)
+
+func TestName(t *testing.T) {
+	m := &schema.MetricData{OrgId: 3, Name: "a.b", Tags: []string{"name=ignored", "dc=us-east", "invalid", "env=prod"}}
+	cases := []struct {
+		tagged    bool
+		orgPrefix string
+		exp       string
+	}{
+		{false, "", "a.b"},
+		{false, "org{org}.", "org3.a.b"},
+		{true, "", "a.b;dc=us-east;env=prod"},
+		{true, "org{org}.", "org3.a.b;dc=us-east;env=prod"},
+	}
+	for _, c := range cases {
+		n := &Carbon{tagged: c.tagged, orgPrefix: c.orgPrefix}
+		if got := n.name(m); got != c.exp {
+			t.Errorf("tagged %t, org prefix %q: expected %q, got %q", c.tagged, c.orgPrefix, c.exp, got)
+		}
+	}
+}
+
+func TestEncodePickleFraming(t *testing.T) {
+	n := &Carbon{proto: "pickle", maxBytes: 100}
+	var metrics []*schema.MetricData
+	for i := 0; i < 10; i++ {
+		metrics = append(metrics, &schema.MetricData{Name: "some.metric", Time: 1500000000, Value: float64(i)})
+	}
+	msgs := n.encode(metrics)
+	var num int
+	for i, msg := range msgs {
+		if len(msg.data) > n.maxBytes {
+			t.Fatalf("message %d: expected at most %d bytes, got %d", i, n.maxBytes, len(msg.data))
+		}
+		if size := binary.BigEndian.Uint32(msg.data); int(size) != len(msg.data)-4 {
+			t.Fatalf("message %d: length header says %d bytes, but has %d", i, size, len(msg.data)-4)
+		}
+		if !bytes.HasSuffix(msg.data, []byte{opAppends, opStop}) {
+			t.Fatalf("message %d: expected a complete pickle, got %v", i, msg.data)
+		}
+		num += msg.num
+	}
+	if len(msgs) < 2 || num != 10 {
+		t.Fatalf("expected 10 metrics split over several messages, got %d in %d", num, len(msgs))
+	}
+}
+
+func TestUnsent(t *testing.T) {
+	plain := &Carbon{proto: "plain"}
+	data := []byte("a 1.000000 1\nb 2.000000 2\n")
+	cases := []struct {
+		written int
+		exp     string
+	}{
+		{0, "a 1.000000 1\nb 2.000000 2\n"},
+		{5, "a 1.000000 1\nb 2.000000 2\n"},
+		{13, "b 2.000000 2\n"},
+		{20, "b 2.000000 2\n"},
+	}
+	for _, c := range cases {
+		if got := plain.unsent(data, c.written); string(got) != c.exp {
+			t.Errorf("plain, %d written: expected %q, got %q", c.written, c.exp, got)
+		}
+	}
+
+	pickle := &Carbon{proto: "pickle"}
+	first := pickleMessage(appendPickleItem(nil, "a", 1, 1))
+	second := pickleMessage(appendPickleItem(nil, "b", 2, 2))
+	data = append(append([]byte(nil), first...), second...)
+	for _, written := range []int{len(first), len(first) + 3, len(first) + len(second) - 1} {
+		if got := pickle.unsent(data, written); !bytes.Equal(got, second) {
+			t.Errorf("pickle, %d written: expected the second message, got %v", written, got)
+		}
+	}
+	if got := pickle.unsent(data, 2); !bytes.Equal(got, data) {
+		t.Errorf("pickle, 2 written: expected both messages, got %v", got)
+	}
+}
+
+func TestReconnect(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	n, err := New(l.Addr().String(), false, "", "plain", "tcp", 0, 0, promstats.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer n.Close()
+
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the server goes away. keep flushing until the client notices
+	conn.Close()
+	var failed int
+	for i := 0; ; i++ {
+		if i == 100 {
+			t.Fatal("expected flushes to fail after the connection was closed")
+		}
+		if err := n.Flush([]*schema.MetricData{{Name: "a", Time: int64(i), Value: 1}}); err != nil {
+			failed = i
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// the client reconnects, and sends the data of the failed flush, followed by new data
+	conn, err = l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := n.Flush([]*schema.MetricData{{Name: "b", Time: 1, Value: 2}}); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	r := bufio.NewReader(conn)
+	var lines []string
+	for len(lines) < 2 {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("expected 2 lines after reconnecting, got %q: %s", lines, err)
+		}
+		lines = append(lines, strings.TrimSuffix(line, "\n"))
+	}
+	exp := []string{"a 1.000000 " + strconv.Itoa(failed), "b 2.000000 1"}
+	if lines[0] != exp[0] || lines[1] != exp[1] {
+		t.Fatalf("expected %q, got %q", exp, lines)
+	}
+}
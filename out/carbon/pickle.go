@@ -0,0 +1,65 @@
+package carbon
+
+import (
+	"encoding/binary"
+	"math"
+)
+
+// pickle opcodes (protocol 2), see python's Lib/pickletools.py
+const (
+	opProto      = 0x80
+	opEmptyList  = ']'
+	opMark       = '('
+	opAppends    = 'e'
+	opStop       = '.'
+	opBinUnicode = 'X'
+	opBinInt     = 'J'
+	opLong1      = 0x8a
+	opBinFloat   = 'G'
+	opTuple2     = 0x86
+)
+
+// pickleOverhead is the number of bytes of a pickle message not taken up by its items:
+// the length header, the protocol marker, and the opcodes around the list of items
+const pickleOverhead = 4 + 2 + 1 + 1 + 1 + 1
+
+// appendPickleItem appends a (name, (timestamp, value)) tuple
+// in the format expected by the carbon pickle receiver
+func appendPickleItem(b []byte, name string, ts int64, value float64) []byte {
+	b = append(b, opBinUnicode)
+	b = appendUint32(b, uint32(len(name)))
+	b = append(b, name...)
+
+	if ts >= math.MinInt32 && ts <= math.MaxInt32 {
+		b = append(b, opBinInt)
+		b = appendUint32(b, uint32(int32(ts)))
+	} else {
+		b = append(b, opLong1, 8)
+		var buf [8]byte
+		binary.LittleEndian.PutUint64(buf[:], uint64(ts))
+		b = append(b, buf[:]...)
+	}
+
+	b = append(b, opBinFloat)
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], math.Float64bits(value))
+	b = append(b, buf[:]...)
+
+	return append(b, opTuple2, opTuple2)
+}
+
+// pickleMessage wraps the pickled items into a list, prefixed by the length header
+func pickleMessage(items []byte) []byte {
+	b := make([]byte, 4, len(items)+pickleOverhead)
+	b = append(b, opProto, 2, opEmptyList, opMark)
+	b = append(b, items...)
+	b = append(b, opAppends, opStop)
+	binary.BigEndian.PutUint32(b, uint32(len(b)-4))
+	return b
+}
+
+func appendUint32(b []byte, v uint32) []byte {
+	var buf [4]byte
+	binary.LittleEndian.PutUint32(buf[:], v)
+	return append(b, buf[:]...)
+}
@@ -0,0 +1,26 @@
+package carbon
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestPickleMessage(t *testing.T) {
+	var items []byte
+	items = appendPickleItem(items, "a.b", 1500000000, 1.5)
+	msg := pickleMessage(items)
+	// same as python's pickle.dumps([("a.b", (1500000000, 1.5))], protocol=2)
+	// but without the memoization opcodes, and with MARK + APPENDS rather than APPEND
+	exp := []byte{
+		0, 0, 0, 30, // length header
+		0x80, 2, ']', '(',
+		'X', 3, 0, 0, 0, 'a', '.', 'b',
+		'J', 0x00, 0x2f, 0x68, 0x59,
+		'G', 0x3f, 0xf8, 0, 0, 0, 0, 0, 0,
+		0x86, 0x86,
+		'e', '.',
+	}
+	if !bytes.Equal(msg, exp) {
+		t.Fatalf("expected %v, got %v", exp, msg)
+	}
+}
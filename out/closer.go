@@ -0,0 +1,100 @@
+package out
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrClosed is returned when flushing to an output that has been closed
+var ErrClosed = errors.New("output is closed")
+
+// CloseTimeout is how long closing an output waits for its queued messages to be published.
+// after that, failing messages are no longer retried, and the remaining ones are dropped.
+var CloseTimeout = 30 * time.Second
+
+// Closer coordinates closing an output that publishes queued messages in the background:
+// nothing can be queued anymore once the queue is closed, and Close doesn't wait for a
+// publisher that keeps retrying any longer than CloseTimeout.
+type Closer struct {
+	lock    sync.RWMutex
+	closed  bool
+	abort   chan struct{} // closed when the publisher must stop retrying
+	aborted sync.Once
+	done    chan struct{} // closed once the publisher has drained the queue
+	dropped int64         // metrics dropped because of the abort. accessed atomically
+}
+
+func NewCloser() *Closer {
+	return &Closer{
+		abort: make(chan struct{}),
+		done:  make(chan struct{}),
+	}
+}
+
+// Queue calls send to queue a message, unless the output is closed
+func (c *Closer) Queue(send func()) error {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	if c.closed {
+		return ErrClosed
+	}
+	send()
+	return nil
+}
+
+// Close closes the queue using closeQueue, and waits for the publisher to drain it.
+// if that takes longer than CloseTimeout, the publisher is aborted.
+func (c *Closer) Close(closeQueue func()) error {
+	// a flush may be blocked on a full queue, so the timeout already applies to getting the lock
+	timer := time.AfterFunc(CloseTimeout, func() {
+		c.aborted.Do(func() { close(c.abort) })
+	})
+	defer timer.Stop()
+
+	c.lock.Lock()
+	if c.closed {
+		c.lock.Unlock()
+		return nil
+	}
+	c.closed = true
+	closeQueue()
+	c.lock.Unlock()
+
+	<-c.done
+	if dropped := atomic.LoadInt64(&c.dropped); dropped > 0 {
+		return fmt.Errorf("could not publish everything within %s. dropped %d metrics", CloseTimeout, dropped)
+	}
+	return nil
+}
+
+// Aborted returns whether the publisher must drop its messages rather than (re)trying to publish them.
+// the publisher should call Drop for each message it drops.
+func (c *Closer) Aborted() bool {
+	select {
+	case <-c.abort:
+		return true
+	default:
+	}
+	return false
+}
+
+// Drop registers that num metrics were dropped because of the abort
+func (c *Closer) Drop(num int) {
+	atomic.AddInt64(&c.dropped, int64(num))
+}
+
+// Sleep waits for the given duration before a retry, or until the publisher gets aborted
+func (c *Closer) Sleep(dur time.Duration) {
+	select {
+	case <-c.abort:
+	case <-time.After(dur):
+	}
+}
+
+// Done must be called by the publisher once it has drained the queue
+func (c *Closer) Done() {
+	close(c.done)
+}
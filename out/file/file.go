@@ -0,0 +1,323 @@
+package file
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/grafana/metrictank/schema"
+	"github.com/raintank/fakemetrics/out"
+	"github.com/raintank/met"
+)
+
+// a recording consists of the magic header, followed by one record per flushed batch.
+// each record is:
+// * uint64 time of the flush in unix nanoseconds
+// * uint32 number of entries
+// * the entries, each consisting of a uint8 kind, a uint32 length and a payload of that length
+// all numbers are big endian. the file may be gzipped as a whole.
+var magic = []byte("FMR1")
+
+// maxEntrySize is the size of the largest entry we accept when reading.
+// real entries are much smaller, even with many tags: anything larger means the recording is corrupt
+const maxEntrySize = 64 * 1024 * 1024
+
+// entry kinds
+const (
+	kindMetricData  = 0 // msgp encoded MetricData
+	kindMetricPoint = 1 // MetricPoint, for a series that was previously recorded as MetricData
+	kindFull        = 2 // msgp encoded MetricData that was sent in full, e.g. because of injected faults. not used to complete MetricPoints
+)
+
+var errClosed = errors.New("output is closed")
+
+// File records every flushed batch to a file, so that it can be replayed later.
+type File struct {
+	sync.Mutex
+	out.OutStats
+	f      *os.File
+	gz     *gzip.Writer
+	w      *bufio.Writer
+	points bool                // whether to write MetricPoints for series we've already written as MetricData
+	seen   map[string]struct{} // ids of series already written as MetricData
+	closed bool
+}
+
+// New creates a file output writing to path. format is metricdata or metricpoint.
+// with metricpoint, series are only recorded as MetricData the first time,
+// and as the more compact MetricPoint after that, except for points with a timestamp
+// that doesn't fit the uint32 of a MetricPoint.
+func New(path, format string, compress bool, stats met.Backend) (*File, error) {
+	if format != "metricdata" && format != "metricpoint" {
+		return nil, fmt.Errorf("invalid format %q. must be metricdata or metricpoint", format)
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	fo := &File{
+		OutStats: out.NewStats(stats, "file"),
+		f:        f,
+		points:   format == "metricpoint",
+		seen:     make(map[string]struct{}),
+	}
+	if compress {
+		fo.gz = gzip.NewWriter(f)
+		fo.w = bufio.NewWriter(fo.gz)
+	} else {
+		fo.w = bufio.NewWriter(f)
+	}
+	if _, err := fo.w.Write(magic); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return fo, nil
+}
+
+func (f *File) Close() error {
+	f.Lock()
+	defer f.Unlock()
+	if f.closed {
+		return nil
+	}
+	f.closed = true
+	err := f.w.Flush()
+	if f.gz != nil {
+		if gzErr := f.gz.Close(); err == nil {
+			err = gzErr
+		}
+	}
+	if fErr := f.f.Close(); err == nil {
+		err = fErr
+	}
+	return err
+}
+
+func (f *File) Flush(metrics []*schema.MetricData) error {
+	return f.flush(metrics, false)
+}
+
+// FlushFull records the metrics as MetricData, regardless of the format
+func (f *File) FlushFull(metrics []*schema.MetricData) error {
+	return f.flush(metrics, true)
+}
+
+func (f *File) flush(metrics []*schema.MetricData, full bool) error {
+	if len(metrics) == 0 {
+		f.FlushDuration.Value(0)
+		return nil
+	}
+	preFlush := time.Now()
+
+	var hdr [12]byte
+	binary.BigEndian.PutUint64(hdr[:], uint64(preFlush.UnixNano()))
+	binary.BigEndian.PutUint32(hdr[8:], uint32(len(metrics)))
+	buf := append([]byte(nil), hdr[:]...)
+
+	f.Lock()
+	defer f.Unlock()
+	if f.closed {
+		return errClosed
+	}
+
+	for _, m := range metrics {
+		var err error
+		kind := byte(kindMetricData)
+		start := len(buf)
+		buf = append(buf, 0, 0, 0, 0, 0)
+		_, ok := f.seen[m.Id]
+		if full {
+			kind = kindFull
+			buf, err = m.MarshalMsg(buf)
+		} else if f.points && ok && m.Time >= 0 && m.Time <= math.MaxUint32 {
+			var mkey schema.MKey
+			mkey, err = schema.MKeyFromString(m.Id)
+			if err != nil {
+				return err
+			}
+			mp := schema.MetricPoint{
+				MKey:  mkey,
+				Value: m.Value,
+				Time:  uint32(m.Time),
+			}
+			kind = kindMetricPoint
+			buf, err = mp.Marshal(buf)
+		} else {
+			buf, err = m.MarshalMsg(buf)
+			if f.points {
+				f.seen[m.Id] = struct{}{}
+			}
+		}
+		if err != nil {
+			return err
+		}
+		buf[start] = kind
+		binary.BigEndian.PutUint32(buf[start+1:], uint32(len(buf)-start-5))
+	}
+
+	// flush all the way down to the file after every batch, so that the recording is usable
+	// even if we never get to close it properly.
+	prePub := time.Now()
+	_, err := f.w.Write(buf)
+	if err == nil {
+		err = f.w.Flush()
+	}
+	if err == nil && f.gz != nil {
+		err = f.gz.Flush()
+	}
+	if err != nil {
+		f.PublishErrors.Inc(1)
+		return err
+	}
+	f.MessageBytes.Value(int64(len(buf)))
+	f.MessageMetrics.Value(int64(len(metrics)))
+	f.PublishedMetrics.Inc(int64(len(metrics)))
+	f.PublishedMessages.Inc(1)
+	f.PublishDuration.Value(time.Since(prePub))
+	f.FlushDuration.Value(time.Since(preFlush))
+	return nil
+}
+
+// Reader reads back the batches of a recording
+type Reader struct {
+	f       *os.File
+	r       *bufio.Reader
+	data    map[string]schema.MetricData // MetricData of each series seen so far by id, to complete MetricPoints
+	full    bool                         // whether the last batch was sent in full
+	skipped int                          // entries that could not be decoded
+}
+
+// NewReader opens a recording. gzipped recordings are detected automatically.
+func NewReader(path string) (*Reader, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	r := bufio.NewReader(f)
+	peek, err := r.Peek(2)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("can't read recording: %s", err)
+	}
+	if peek[0] == 0x1f && peek[1] == 0x8b {
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		r = bufio.NewReader(gz)
+	}
+	hdr := make([]byte, len(magic))
+	if _, err := io.ReadFull(r, hdr); err != nil || string(hdr) != string(magic) {
+		f.Close()
+		return nil, errors.New("not a fakemetrics recording")
+	}
+	return &Reader{
+		f:    f,
+		r:    r,
+		data: make(map[string]schema.MetricData),
+	}, nil
+}
+
+func (r *Reader) Close() error {
+	return r.f.Close()
+}
+
+// Skipped returns how many entries were skipped so far, because they could not be decoded
+func (r *Reader) Skipped() int {
+	return r.skipped
+}
+
+// Full returns whether the batch last returned by Next was sent as full MetricData, and must be replayed as such
+func (r *Reader) Full() bool {
+	return r.full
+}
+
+// Next returns the time of the next batch, and its metrics.
+// entries that can't be decoded are skipped. see Skipped.
+// it returns io.EOF when there are no more batches.
+func (r *Reader) Next() (time.Time, []*schema.MetricData, error) {
+	var hdr [12]byte
+	_, err := io.ReadFull(r.r, hdr[:])
+	if err != nil {
+		if err == io.ErrUnexpectedEOF {
+			err = errors.New("recording is truncated")
+		}
+		return time.Time{}, nil, err
+	}
+	t := time.Unix(0, int64(binary.BigEndian.Uint64(hdr[:])))
+	num := binary.BigEndian.Uint32(hdr[8:])
+
+	// num comes from the file, so we don't trust it for the allocation. a corrupt count fails once the entries run out
+	capacity := num
+	if capacity > 4096 {
+		capacity = 4096
+	}
+	metrics := make([]*schema.MetricData, 0, capacity)
+	r.full = false
+	var buf []byte
+	for i := uint32(0); i < num; i++ {
+		var entryHdr [5]byte
+		if _, err := io.ReadFull(r.r, entryHdr[:]); err != nil {
+			return t, nil, errors.New("recording is truncated")
+		}
+		size := binary.BigEndian.Uint32(entryHdr[1:])
+		if size > maxEntrySize {
+			return t, nil, fmt.Errorf("recording is corrupt: entry of %d bytes", size)
+		}
+		if cap(buf) < int(size) {
+			buf = make([]byte, size)
+		}
+		buf = buf[:size]
+		if _, err := io.ReadFull(r.r, buf); err != nil {
+			return t, nil, errors.New("recording is truncated")
+		}
+
+		md, err := r.decode(entryHdr[0], buf)
+		if err != nil {
+			r.skipped++
+			continue
+		}
+		metrics = append(metrics, md)
+	}
+	return t, metrics, nil
+}
+
+// decode decodes an entry of the given kind
+func (r *Reader) decode(kind byte, buf []byte) (*schema.MetricData, error) {
+	md := &schema.MetricData{}
+	switch kind {
+	case kindMetricData:
+		if _, err := md.UnmarshalMsg(buf); err != nil {
+			return nil, err
+		}
+		r.data[md.Id] = *md
+	case kindFull:
+		if _, err := md.UnmarshalMsg(buf); err != nil {
+			return nil, err
+		}
+		r.full = true
+	case kindMetricPoint:
+		var mp schema.MetricPoint
+		if _, err := mp.Unmarshal(buf); err != nil {
+			return nil, err
+		}
+		known, ok := r.data[mp.MKey.String()]
+		if !ok {
+			return nil, fmt.Errorf("MetricPoint for unknown series %s", mp.MKey)
+		}
+		*md = known
+		md.Value = mp.Value
+		md.Time = int64(mp.Time)
+	default:
+		return nil, fmt.Errorf("entry of unknown kind %d", kind)
+	}
+	return md, nil
+}
@@ -0,0 +1,175 @@
+package file
+
+import (
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/grafana/metrictank/schema"
+	"github.com/raintank/fakemetrics/promstats"
+)
+
+// readAll reads all batches of the recording, and whether each was sent in full
+func readAll(t *testing.T, path string) ([][]*schema.MetricData, []bool, int) {
+	r, err := NewReader(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	var batches [][]*schema.MetricData
+	var full []bool
+	for {
+		_, metrics, err := r.Next()
+		if err == io.EOF {
+			return batches, full, r.Skipped()
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		batches = append(batches, metrics)
+		full = append(full, r.Full())
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fakemetrics-file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	a := schema.MetricData{Id: "1.0123456789abcdef0123456789abcdef", OrgId: 1, Name: "a", Interval: 10, Tags: []string{"a=b"}}
+	b := schema.MetricData{Id: "2.fedcba9876543210fedcba9876543210", OrgId: 2, Name: "b", Interval: 60, Tags: []string{"c=d"}}
+	point := func(md schema.MetricData, ts int64, val float64) *schema.MetricData {
+		md.Time, md.Value = ts, val
+		return &md
+	}
+	batches := [][]*schema.MetricData{
+		{point(a, 1500000000, 1), point(b, 1500000000, 2)},
+		{point(a, 1500000010, 3), point(b, 1500000060, 4)},
+		// beyond the range of the uint32 timestamp of MetricPoints
+		{point(a, math.MaxUint32+10, 5), point(b, -60, 6)},
+	}
+	faulty := point(a, 1500000020, 7)
+	faulty.Name = "a.mismatch"
+
+	for _, format := range []string{"metricdata", "metricpoint"} {
+		for _, compress := range []bool{false, true} {
+			path := filepath.Join(dir, format)
+			f, err := New(path, format, compress, promstats.New())
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, batch := range batches {
+				if err := f.Flush(batch); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := f.FlushFull([]*schema.MetricData{faulty}); err != nil {
+				t.Fatal(err)
+			}
+			if err := f.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if err := f.Flush(batches[0]); err == nil {
+				t.Fatalf("format %s, compress %t: expected error flushing after close", format, compress)
+			}
+
+			got, full, skipped := readAll(t, path)
+			exp := [][]*schema.MetricData{batches[0], batches[1], batches[2], {faulty}}
+			if !reflect.DeepEqual(got, exp) || skipped != 0 {
+				t.Fatalf("format %s, compress %t: expected %v, got %v with %d skipped", format, compress, exp, got, skipped)
+			}
+			if !reflect.DeepEqual(full, []bool{false, false, false, true}) {
+				t.Fatalf("format %s, compress %t: expected only the last batch to be full, got %v", format, compress, full)
+			}
+		}
+	}
+}
+
+func TestReaderSkipsBadEntries(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fakemetrics-file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	md := schema.MetricData{Id: "1.0123456789abcdef0123456789abcdef", OrgId: 1, Name: "a", Interval: 10, Time: 1500000000, Tags: []string{"a=b"}}
+	valid, err := md.MarshalMsg(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mp := schema.MetricPoint{MKey: schema.MKey{Org: 3}, Time: 1500000000}
+	unknown, err := mp.Marshal(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries := []struct {
+		kind byte
+		data []byte
+	}{
+		{kindMetricPoint, unknown},
+		{kindMetricData, []byte{0xc1}},
+		{kindMetricData, valid},
+		{7, valid},
+	}
+
+	var hdr [12]byte
+	binary.BigEndian.PutUint64(hdr[:], uint64(time.Now().UnixNano()))
+	binary.BigEndian.PutUint32(hdr[8:], uint32(len(entries)))
+	data := append(append([]byte(nil), magic...), hdr[:]...)
+	for _, e := range entries {
+		var entryHdr [5]byte
+		entryHdr[0] = e.kind
+		binary.BigEndian.PutUint32(entryHdr[1:], uint32(len(e.data)))
+		data = append(append(data, entryHdr[:]...), e.data...)
+	}
+	path := filepath.Join(dir, "bad")
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	got, _, skipped := readAll(t, path)
+	if len(got) != 1 || len(got[0]) != 1 || !reflect.DeepEqual(*got[0][0], md) || skipped != 3 {
+		t.Fatalf("expected only the valid entry, and 3 skipped. got %v with %d skipped", got, skipped)
+	}
+}
+
+func TestReaderCorruptSizes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fakemetrics-file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// a huge amount of entries, without the entries, and a single entry with a huge size.
+	// both must fail without allocating for what the headers claim
+	var hdr [12]byte
+	binary.BigEndian.PutUint64(hdr[:], uint64(time.Now().UnixNano()))
+	binary.BigEndian.PutUint32(hdr[8:], math.MaxUint32)
+	truncated := append(append([]byte(nil), magic...), hdr[:]...)
+	binary.BigEndian.PutUint32(hdr[8:], 1)
+	huge := append(append([]byte(nil), magic...), hdr[:]...)
+	huge = append(huge, kindMetricData, 0xff, 0xff, 0xff, 0xff)
+
+	for name, data := range map[string][]byte{"truncated": truncated, "huge": huge} {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		r, err := NewReader(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := r.Next(); err == nil || err == io.EOF {
+			t.Errorf("%s: expected an error, got %v", name, err)
+		}
+		r.Close()
+	}
+}
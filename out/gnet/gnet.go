@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"net"
 	"net/http"
+	"sync"
 	"time"
 
 	"github.com/grafana/metrictank/schema"
@@ -17,26 +18,34 @@ import (
 )
 
 type Msg struct {
-	data []byte
-	num  int // metrics contained within
+	data   []byte
+	num    int // metrics contained within
+	bearer string
 }
 
+// KeyFunc returns the api key to use for the given org
+type KeyFunc func(org int) (string, error)
+
 type Gnet struct {
 	out.OutStats
 
 	url    string
-	key    string
-	bearer string
+	keys   KeyFunc
 	client *http.Client
 
+	sync.Mutex
+	bearers map[int]string // cache of bearer header per org
+
 	bufSize   int // amount of messages we can buffer up before providing backpressure.
 	timeout   time.Duration
 	sslVerify bool
 
-	queue chan Msg
+	queue  chan Msg
+	closer *out.Closer
 }
 
-func New(url, key string, stats met.Backend) (*Gnet, error) {
+// New creates a gnet output. metrics of each org are published with the key of that org.
+func New(url string, keys KeyFunc, stats met.Backend) (*Gnet, error) {
 
 	bufSize := 100
 	timeout := 3 * time.Second
@@ -45,9 +54,9 @@ func New(url, key string, stats met.Backend) (*Gnet, error) {
 	gnet := &Gnet{
 		OutStats: out.NewStats(stats, "gnet"),
 
-		url:    url,
-		key:    key,
-		bearer: fmt.Sprintf("Bearer " + key),
+		url:     url,
+		keys:    keys,
+		bearers: make(map[int]string),
 		client: &http.Client{
 			Timeout: timeout,
 		},
@@ -56,7 +65,8 @@ func New(url, key string, stats met.Backend) (*Gnet, error) {
 		timeout:   timeout,
 		sslVerify: sslVerify,
 
-		queue: make(chan Msg, bufSize),
+		queue:  make(chan Msg, bufSize),
+		closer: out.NewCloser(),
 	}
 
 	if !sslVerify {
@@ -81,7 +91,8 @@ func New(url, key string, stats met.Backend) (*Gnet, error) {
 }
 
 func (g *Gnet) Close() error {
-	return nil
+	// wait for everything that was queued to be published
+	return g.closer.Close(func() { close(g.queue) })
 }
 
 func (g *Gnet) Flush(metrics []*schema.MetricData) error {
@@ -91,15 +102,59 @@ func (g *Gnet) Flush(metrics []*schema.MetricData) error {
 	}
 	preFlush := time.Now()
 	log.Debug("gnet asked to publish %d metrics at ts %s", len(metrics), time.Unix(metrics[0].Time, 0))
-	mda := schema.MetricDataArray(metrics)
-	data, err := msg.CreateMsg(mda, 0, msg.FormatMetricDataArrayMsgp)
-	if err != nil {
-		panic(err)
+
+	byOrg := make(map[int][]*schema.MetricData)
+	var orgs []int
+	for _, m := range metrics {
+		if _, ok := byOrg[m.OrgId]; !ok {
+			orgs = append(orgs, m.OrgId)
+		}
+		byOrg[m.OrgId] = append(byOrg[m.OrgId], m)
+	}
+
+	// an org we have no key for must not hold up the other orgs
+	var firstErr error
+	for _, org := range orgs {
+		bearer, err := g.bearer(org)
+		if err != nil {
+			g.PublishErrors.Inc(1)
+			if firstErr == nil {
+				firstErr = fmt.Errorf("can't publish %d metrics of org %d: %s", len(byOrg[org]), org, err)
+			}
+			continue
+		}
+		mda := schema.MetricDataArray(byOrg[org])
+		data, err := msg.CreateMsg(mda, 0, msg.FormatMetricDataArrayMsgp)
+		if err != nil {
+			panic(err)
+		}
+		err = g.closer.Queue(func() {
+			g.PublishQueued.Inc(int64(len(mda)))
+			g.queue <- Msg{data, len(mda), bearer}
+		})
+		if err != nil {
+			return err
+		}
 	}
-	g.PublishQueued.Inc(int64(len(metrics)))
-	g.queue <- Msg{data, len(metrics)}
 	g.FlushDuration.Value(time.Since(preFlush))
-	return nil
+	return firstErr
+}
+
+// bearer returns the authorization header value for the org
+func (g *Gnet) bearer(org int) (string, error) {
+	g.Lock()
+	defer g.Unlock()
+	bearer, ok := g.bearers[org]
+	if ok {
+		return bearer, nil
+	}
+	key, err := g.keys(org)
+	if err != nil {
+		return "", err
+	}
+	bearer = fmt.Sprintf("Bearer %s", key)
+	g.bearers[org] = bearer
+	return bearer, nil
 }
 
 func (g *Gnet) run() {
@@ -109,6 +164,7 @@ func (g *Gnet) run() {
 		g.publish(m)
 		g.PublishDuration.Value(time.Since(prePub))
 	}
+	g.closer.Done()
 }
 
 func (g *Gnet) publish(m Msg) {
@@ -120,6 +176,10 @@ func (g *Gnet) publish(m Msg) {
 	}
 
 	for {
+		if g.closer.Aborted() {
+			g.closer.Drop(m.num)
+			break
+		}
 		g.MessageBytes.Value(int64(len(m.data)))
 		g.MessageMetrics.Value(int64(m.num))
 		pre := time.Now()
@@ -127,7 +187,7 @@ func (g *Gnet) publish(m Msg) {
 		if err != nil {
 			panic(err)
 		}
-		req.Header.Add("Authorization", g.bearer)
+		req.Header.Add("Authorization", m.bearer)
 		req.Header.Add("Content-Type", "rt-metric-binary")
 		resp, err := g.client.Do(req)
 		diff := time.Since(pre)
@@ -152,6 +212,6 @@ func (g *Gnet) publish(m Msg) {
 			resp.Body.Close()
 		}
 
-		time.Sleep(dur)
+		g.closer.Sleep(dur)
 	}
 }
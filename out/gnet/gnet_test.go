@@ -0,0 +1,52 @@
+package gnet
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"sync"
+	"testing"
+
+	"github.com/grafana/metrictank/schema"
+	"github.com/raintank/fakemetrics/promstats"
+)
+
+func TestFlushSkipsOrgWithoutKey(t *testing.T) {
+	var lock sync.Mutex
+	var got []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		got = append(got, r.Header.Get("Authorization"))
+		lock.Unlock()
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	// like the invalid-orgid fault makes, org 0 has no key
+	keys := func(org int) (string, error) {
+		if org < 1 {
+			return "", fmt.Errorf("no key for org %d", org)
+		}
+		return fmt.Sprintf("key%d", org), nil
+	}
+	g, err := New(srv.URL, keys, promstats.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var metrics []*schema.MetricData
+	for _, org := range []int{1, 0, 2} {
+		metrics = append(metrics, &schema.MetricData{Name: "a", OrgId: org, Interval: 1, Time: 1500000000, Tags: []string{"a=b"}})
+	}
+	if err := g.Flush(metrics); err == nil {
+		t.Fatal("expected an error for the org without key")
+	}
+	if err := g.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	sort.Strings(got)
+	if len(got) != 2 || got[0] != "Bearer key1" || got[1] != "Bearer key2" {
+		t.Fatalf("expected the metrics of the orgs with a key to be published, got requests with %q", got)
+	}
+}
@@ -0,0 +1,305 @@
+package influx
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/grafana/metrictank/schema"
+	"github.com/jpillora/backoff"
+	"github.com/raintank/fakemetrics/out"
+	"github.com/raintank/met"
+	"github.com/raintank/worldping-api/pkg/log"
+)
+
+// maxDatagram is the max udp payload we send, to stay within a 1500 byte MTU
+const maxDatagram = 1500 - 28
+
+var precisions = map[string]int64{
+	"s":  int64(time.Second),
+	"ms": int64(time.Millisecond),
+	"u":  int64(time.Microsecond),
+	"ns": int64(time.Nanosecond),
+}
+
+type Msg struct {
+	data []byte
+	num  int // metrics contained within
+}
+
+// Influx sends metrics in the InfluxDB line protocol,
+// either in batches to the http /write endpoint, or as udp datagrams.
+// each metric becomes a point with a single "value" field.
+// the line protocol has no NaN or infinite values, so such points are skipped and counted.
+type Influx struct {
+	out.OutStats
+
+	url        string // for http
+	udp        net.Conn
+	precision  string
+	multiplier int64 // to convert a timestamp in seconds to the precision
+	batchSize  int   // max amount of points per http request
+	nodes      int   // number of leading nodes of the name to use as measurement. 0 for the whole name
+	client     *http.Client
+
+	sync.Mutex // protects udp writes
+
+	queue  chan Msg // for http
+	closer *out.Closer
+
+	nonFinite met.Count // points not sent, because the line protocol can't represent their NaN or infinite value
+}
+
+// New creates an influx output. addr is either an http(s) url of the /write endpoint, such as
+// http://localhost:8086/write?db=fakemetrics or a udp address such as udp://localhost:8089
+// precision is one of s, ms, u or ns.
+// if nodes > 0, only the first nodes nodes of the name are used as measurement,
+// and the remainder of the name is stored in the "series" tag.
+func New(addr, precision string, batchSize, nodes int, stats met.Backend) (*Influx, error) {
+	multiplier, ok := precisions[precision]
+	if !ok {
+		return nil, fmt.Errorf("invalid precision %q. must be one of s, ms, u or ns", precision)
+	}
+	u, err := url.Parse(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	i := &Influx{
+		OutStats:   out.NewStats(stats, "influx"),
+		precision:  precision,
+		multiplier: int64(time.Second) / multiplier,
+		batchSize:  batchSize,
+		nodes:      nodes,
+		nonFinite:  stats.NewCount("metricpublisher.out.influx.non_finite_skipped"),
+	}
+
+	switch u.Scheme {
+	case "udp":
+		i.udp, err = net.Dial("udp", u.Host)
+		if err != nil {
+			return nil, err
+		}
+		return i, nil
+	case "http", "https":
+		q := u.Query()
+		q.Set("precision", precision)
+		u.RawQuery = q.Encode()
+		i.url = u.String()
+		i.client = &http.Client{
+			Timeout: 10 * time.Second,
+		}
+		i.queue = make(chan Msg, 100)
+		i.closer = out.NewCloser()
+		go i.run()
+		return i, nil
+	}
+	return nil, fmt.Errorf("invalid scheme %q. must be http, https or udp", u.Scheme)
+}
+
+func (i *Influx) Close() error {
+	if i.udp != nil {
+		return i.udp.Close()
+	}
+	// wait for everything that was queued to be published
+	return i.closer.Close(func() { close(i.queue) })
+}
+
+func (i *Influx) Flush(metrics []*schema.MetricData) error {
+	if len(metrics) == 0 {
+		i.FlushDuration.Value(0)
+		return nil
+	}
+	preFlush := time.Now()
+	metrics = out.SkipNonFinite(metrics, i.nonFinite)
+	if i.udp != nil {
+		err := i.flushUDP(metrics)
+		i.FlushDuration.Value(time.Since(preFlush))
+		return err
+	}
+
+	for len(metrics) > 0 {
+		n := i.batchSize
+		if n > len(metrics) {
+			n = len(metrics)
+		}
+		var data []byte
+		for _, m := range metrics[:n] {
+			data = i.appendLine(data, m)
+		}
+		err := i.closer.Queue(func() {
+			i.PublishQueued.Inc(int64(n))
+			i.queue <- Msg{data, n}
+		})
+		if err != nil {
+			return err
+		}
+		metrics = metrics[n:]
+	}
+	i.FlushDuration.Value(time.Since(preFlush))
+	return nil
+}
+
+// flushUDP sends the metrics in datagrams of at most maxDatagram bytes
+func (i *Influx) flushUDP(metrics []*schema.MetricData) error {
+	i.Lock()
+	defer i.Unlock()
+	var firstErr error
+	var data, line []byte
+	var num int
+	send := func() {
+		if num == 0 {
+			return
+		}
+		prePub := time.Now()
+		_, err := i.udp.Write(data)
+		if err != nil {
+			i.PublishErrors.Inc(1)
+			if firstErr == nil {
+				firstErr = err
+			}
+		} else {
+			i.MessageBytes.Value(int64(len(data)))
+			i.MessageMetrics.Value(int64(num))
+			i.PublishedMetrics.Inc(int64(num))
+			i.PublishedMessages.Inc(1)
+			i.PublishDuration.Value(time.Since(prePub))
+		}
+		data, num = data[:0], 0
+	}
+	for _, m := range metrics {
+		line = i.appendLine(line[:0], m)
+		if num > 0 && len(data)+len(line) > maxDatagram {
+			send()
+		}
+		data = append(data, line...)
+		num++
+	}
+	send()
+	return firstErr
+}
+
+// appendLine appends the metric as a line in the line protocol:
+// measurement[,tag=value...] value=<value> <timestamp>
+func (i *Influx) appendLine(b []byte, m *schema.MetricData) []byte {
+	measurement, series := m.Name, ""
+	if i.nodes > 0 {
+		pos := 0
+		for n := 0; n < i.nodes; n++ {
+			next := strings.IndexByte(m.Name[pos:], '.')
+			if next < 0 {
+				pos = len(m.Name)
+				break
+			}
+			pos += next + 1
+		}
+		if pos < len(m.Name) {
+			measurement, series = m.Name[:pos-1], m.Name[pos:]
+		}
+	}
+	b = appendEscaped(b, measurement, ", ")
+	if series != "" {
+		b = append(b, ",series="...)
+		b = appendEscaped(b, series, ",= ")
+	}
+	for _, tag := range m.Tags {
+		parts := strings.SplitN(tag, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			continue
+		}
+		b = append(b, ',')
+		b = appendEscaped(b, parts[0], ",= ")
+		b = append(b, '=')
+		b = appendEscaped(b, parts[1], ",= ")
+	}
+	b = append(b, " value="...)
+	b = strconv.AppendFloat(b, m.Value, 'g', -1, 64)
+	b = append(b, ' ')
+	b = strconv.AppendInt(b, m.Time*i.multiplier, 10)
+	return append(b, '\n')
+}
+
+// appendEscaped appends s, with all of the special characters backslash-escaped
+func appendEscaped(b []byte, s, special string) []byte {
+	for j := 0; j < len(s); j++ {
+		if strings.IndexByte(special, s[j]) >= 0 {
+			b = append(b, '\\')
+		}
+		b = append(b, s[j])
+	}
+	return b
+}
+
+func (i *Influx) run() {
+	for m := range i.queue {
+		i.PublishQueued.Dec(int64(m.num))
+		prePub := time.Now()
+		i.publish(m)
+		i.PublishDuration.Value(time.Since(prePub))
+	}
+	i.closer.Done()
+}
+
+func (i *Influx) publish(m Msg) {
+	b := &backoff.Backoff{
+		Min:    100 * time.Millisecond,
+		Max:    time.Minute,
+		Factor: 1.5,
+		Jitter: true,
+	}
+
+	for {
+		if i.closer.Aborted() {
+			i.closer.Drop(m.num)
+			break
+		}
+		i.MessageBytes.Value(int64(len(m.data)))
+		i.MessageMetrics.Value(int64(m.num))
+		pre := time.Now()
+		req, err := http.NewRequest("POST", i.url, bytes.NewBuffer(m.data))
+		if err != nil {
+			panic(err)
+		}
+		req.Header.Add("Content-Type", "text/plain; charset=utf-8")
+		resp, err := i.client.Do(req)
+		diff := time.Since(pre)
+
+		if err == nil && resp.StatusCode >= 200 && resp.StatusCode < 300 {
+			log.Debug("influx sent %d metrics in %s -msg size %d", m.num, diff, len(m.data))
+			b.Reset()
+			resp.Body.Close()
+			i.PublishedMetrics.Inc(int64(m.num))
+			i.PublishedMessages.Inc(1)
+			break
+		}
+
+		i.PublishErrors.Inc(1)
+
+		// client errors won't get better by retrying, except for rate limiting
+		if err == nil && resp.StatusCode >= 400 && resp.StatusCode < 500 && resp.StatusCode != http.StatusTooManyRequests {
+			buf := make([]byte, 300)
+			n, _ := resp.Body.Read(buf)
+			log.Error(0, "influx failed to submit data: http %d - %s: %s dropping %d metrics", resp.StatusCode, resp.Status, buf[:n], m.num)
+			resp.Body.Close()
+			break
+		}
+
+		dur := b.Duration()
+		if err != nil {
+			log.Warn("influx failed to submit data: %s will try again in %s (this attempt took %s)", err, dur, diff)
+		} else {
+			buf := make([]byte, 300)
+			n, _ := resp.Body.Read(buf)
+			log.Warn("influx failed to submit data: http %d - %s: %s will try again in %s (this attempt took %s)", resp.StatusCode, resp.Status, buf[:n], dur, diff)
+			resp.Body.Close()
+		}
+
+		i.closer.Sleep(dur)
+	}
+}
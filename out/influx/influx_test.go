@@ -0,0 +1,160 @@
+package influx
+
+import (
+	"io/ioutil"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/grafana/metrictank/schema"
+	"github.com/raintank/fakemetrics/promstats"
+)
+
+func TestAppendLine(t *testing.T) {
+	cases := []struct {
+		nodes int
+		m     schema.MetricData
+		exp   string
+	}{
+		{0, schema.MetricData{Name: "a.b.c", Value: 1.5, Time: 1500000000}, "a.b.c value=1.5 1500000000\n"},
+		{0, schema.MetricData{Name: "a b,c=d", Value: -2, Time: 1500000000}, "a\\ b\\,c=d value=-2 1500000000\n"},
+		{
+			0,
+			schema.MetricData{Name: "a", Value: 1e21, Time: 1500000000, Tags: []string{"dc=us east", "k,1=v=1", "empty=", "invalid"}},
+			"a,dc=us\\ east,k\\,1=v\\=1 value=1e+21 1500000000\n",
+		},
+		{2, schema.MetricData{Name: "a.b.c.d", Value: 3, Time: 1500000000}, "a.b,series=c.d value=3 1500000000\n"},
+		{2, schema.MetricData{Name: "a.b.c d", Value: 3, Time: 1500000000}, "a.b,series=c\\ d value=3 1500000000\n"},
+		// not enough nodes to split off a series
+		{2, schema.MetricData{Name: "a.b", Value: 3, Time: 1500000000}, "a.b value=3 1500000000\n"},
+	}
+	for _, c := range cases {
+		i := &Influx{multiplier: 1, nodes: c.nodes}
+		if got := string(i.appendLine(nil, &c.m)); got != c.exp {
+			t.Errorf("nodes %d, metric %v: expected %q, got %q", c.nodes, c.m, c.exp, got)
+		}
+	}
+}
+
+func TestFlushHTTP(t *testing.T) {
+	var lock sync.Mutex
+	var bodies []string
+	var precision string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		lock.Lock()
+		bodies = append(bodies, string(body))
+		precision = r.URL.Query().Get("precision")
+		lock.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	i, err := New(srv.URL+"/write?db=test", "ms", 2, 0, promstats.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var metrics []*schema.MetricData
+	for _, name := range []string{"a", "b", "c"} {
+		metrics = append(metrics, &schema.MetricData{Name: name, Value: 1, Time: 1500000000})
+	}
+	if err := i.Flush(metrics); err != nil {
+		t.Fatal(err)
+	}
+	if err := i.Close(); err != nil {
+		t.Fatal(err)
+	}
+	exp := []string{"a value=1 1500000000000\nb value=1 1500000000000\n", "c value=1 1500000000000\n"}
+	if len(bodies) != 2 || bodies[0] != exp[0] || bodies[1] != exp[1] || precision != "ms" {
+		t.Fatalf("expected batches %q with precision ms, got %q with precision %q", exp, bodies, precision)
+	}
+}
+
+func TestFlushUDP(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	i, err := New("udp://"+conn.LocalAddr().String(), "s", 0, 0, promstats.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer i.Close()
+
+	// 100 lines of about 50 bytes don't fit in 1 datagram
+	var metrics []*schema.MetricData
+	for n := 0; n < 100; n++ {
+		metrics = append(metrics, &schema.MetricData{Name: "some.metric.name.of.some.length", Value: float64(n), Time: 1500000000})
+	}
+	if err := i.Flush(metrics); err != nil {
+		t.Fatal(err)
+	}
+	var lines int
+	buf := make([]byte, 65536)
+	for lines < 100 {
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("expected 100 lines, got %d before failing to read: %s", lines, err)
+		}
+		if n > maxDatagram {
+			t.Fatalf("expected datagrams of at most %d bytes, got %d", maxDatagram, n)
+		}
+		if !strings.HasSuffix(string(buf[:n]), "\n") {
+			t.Fatalf("expected whole lines per datagram, got %q", buf[:n])
+		}
+		lines += strings.Count(string(buf[:n]), "\n")
+	}
+}
+
+// count is a met.Count we can read back
+type count struct {
+	val int64
+}
+
+func (c *count) Inc(val int64) { c.val += val }
+
+func TestFlushSkipsNonFinite(t *testing.T) {
+	var lock sync.Mutex
+	var bodies []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		lock.Lock()
+		bodies = append(bodies, string(body))
+		lock.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	i, err := New(srv.URL+"/write?db=test", "s", 10, 0, promstats.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	skipped := &count{}
+	i.nonFinite = skipped
+	var metrics []*schema.MetricData
+	for _, v := range []float64{1, math.NaN(), math.Inf(1), math.Inf(-1), math.MaxFloat32 * 10} {
+		metrics = append(metrics, &schema.MetricData{Name: "a", Value: v, Time: 1500000000})
+	}
+	if err := i.Flush(metrics); err != nil {
+		t.Fatal(err)
+	}
+	if err := i.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the healthy points must still get through, rather than the server rejecting the whole batch
+	exp := "a value=1 1500000000\na value=3.4028234663852886e+39 1500000000\n"
+	if len(bodies) != 1 || bodies[0] != exp {
+		t.Fatalf("expected only the finite points %q, got %q", exp, bodies)
+	}
+	if skipped.val != 3 {
+		t.Fatalf("expected 3 skipped points, got %d", skipped.val)
+	}
+}
@@ -99,3 +99,22 @@ func (k *KafkaMdam) Flush(metrics []*schema.MetricData) error {
 	k.FlushDuration.Value(time.Since(preFlush))
 	return nil
 }
+
+// FlushRaw sends each payload as a message
+func (k *KafkaMdam) FlushRaw(payloads [][]byte) error {
+	for _, data := range payloads {
+		k.MessageBytes.Value(int64(len(data)))
+		prePub := time.Now()
+		_, _, err := k.client.SendMessage(&sarama.ProducerMessage{
+			Topic: k.topic,
+			Value: sarama.ByteEncoder(data),
+		})
+		if err != nil {
+			k.PublishErrors.Inc(1)
+			return err
+		}
+		k.PublishedMessages.Inc(1)
+		k.PublishDuration.Value(time.Since(prePub))
+	}
+	return nil
+}
@@ -24,7 +24,7 @@ type KafkaMdm struct {
 	client        sarama.SyncProducer
 	part          p.Partitioner
 	numPartitions int32
-	v2            bool
+	format        string
 	keyCache      *keycache.KeyCache
 }
 
@@ -45,7 +45,29 @@ func (p *LastNumPartitioner) Partition(m schema.PartitionedMetric, numPartitions
 	return int32(part), nil
 }
 
-func New(topic string, brokers []string, codec string, timeout time.Duration, stats met.Backend, partitionScheme string, v2 bool) (*KafkaMdm, error) {
+// CheckFormat checks whether the format can be used to send metrics of the given number of orgs. format is one of:
+// metricdata: always full MetricData.
+// metricpoint: MetricData the first time a series is seen, MetricPoint after that.
+// metricpoint-without-org: like metricpoint, but MetricPointWithoutOrg, for which the consumer assumes org 1.
+// auto: like metricpoint, but MetricPointWithoutOrg for the series of org 1.
+func CheckFormat(format string, orgs int) error {
+	switch format {
+	case "metricdata", "metricpoint", "auto":
+	case "metricpoint-without-org":
+		if orgs > 1 {
+			return fmt.Errorf("format %s can't be used with more than 1 org, because the consumer assumes org 1 for it. use auto instead", format)
+		}
+	default:
+		return fmt.Errorf("invalid format %q. must be metricdata, metricpoint, metricpoint-without-org or auto", format)
+	}
+	return nil
+}
+
+// New creates a kafka-mdm output. see CheckFormat for the formats.
+func New(topic string, brokers []string, codec string, timeout time.Duration, stats met.Backend, partitionScheme string, format string) (*KafkaMdm, error) {
+	if err := CheckFormat(format, 1); err != nil {
+		return nil, err
+	}
 	// We are looking for strong consistency semantics.
 	// Because we don't change the flush settings, sarama will try to produce messages
 	// as fast as possible to keep latency low.
@@ -100,9 +122,9 @@ func New(topic string, brokers []string, codec string, timeout time.Duration, st
 		client:        producer,
 		part:          part,
 		numPartitions: int32(len(partitions)),
-		v2:            v2,
+		format:        format,
 	}
-	if v2 {
+	if format != "metricdata" {
 		k.keyCache = keycache.NewKeyCache(20*time.Minute, time.Duration(10)*time.Minute)
 	}
 	return k, nil
@@ -113,6 +135,46 @@ func (k *KafkaMdm) Close() error {
 }
 
 func (k *KafkaMdm) Flush(metrics []*schema.MetricData) error {
+	return k.flush(metrics, false)
+}
+
+// FlushFull sends the metrics as MetricData, regardless of the format
+func (k *KafkaMdm) FlushFull(metrics []*schema.MetricData) error {
+	return k.flush(metrics, true)
+}
+
+// encode returns the message for the metric. unless full is set, metrics of series that
+// we have sent recently are encoded as MetricPoint, if the format allows it.
+// it returns whether it could use the MetricPoint encoding.
+func (k *KafkaMdm) encode(metric *schema.MetricData, now time.Time, full bool) ([]byte, bool, error) {
+	if k.format == "metricdata" || full {
+		data, err := metric.MarshalMsg(nil)
+		return data, false, err
+	}
+	mkey, err := schema.MKeyFromString(metric.Id)
+	if err != nil {
+		return nil, false, err
+	}
+	// we haven't seen this key recently. we must send the full MetricData
+	if !k.keyCache.Touch(mkey, now) {
+		data, err := metric.MarshalMsg(nil)
+		return data, false, err
+	}
+	mp := schema.MetricPoint{
+		MKey:  mkey,
+		Value: metric.Value,
+		Time:  uint32(metric.Time),
+	}
+	var data []byte
+	if k.format == "metricpoint-without-org" || (k.format == "auto" && metric.OrgId == 1) {
+		data, err = mp.MarshalWithoutOrg([]byte{byte(msg.FormatMetricPointWithoutOrg)})
+	} else {
+		data, err = mp.Marshal([]byte{byte(msg.FormatMetricPoint)})
+	}
+	return data, true, err
+}
+
+func (k *KafkaMdm) flush(metrics []*schema.MetricData, full bool) error {
 	if len(metrics) == 0 {
 		k.FlushDuration.Value(0)
 		return nil
@@ -125,35 +187,13 @@ func (k *KafkaMdm) Flush(metrics []*schema.MetricData) error {
 	var notOk int
 
 	for i, metric := range metrics {
-		var data []byte
-		var err error
-		if k.v2 {
-			var mkey schema.MKey
-			mkey, err = schema.MKeyFromString(metric.Id)
-			if err != nil {
-				return err
-			}
-			ok := k.keyCache.Touch(mkey, preFlush)
-			// we've seen this key recently. we can use the optimized format
-			if ok {
-				mp := schema.MetricPoint{
-					MKey:  mkey,
-					Value: metric.Value,
-					Time:  uint32(metric.Time),
-				}
-				data = []byte{byte(msg.FormatMetricPoint)}
-				data, err = mp.Marshal(data)
-
-			} else {
-				notOk++
-				data, err = metric.MarshalMsg(data[:])
-			}
-		} else {
-			data, err = metric.MarshalMsg(data[:])
-		}
+		data, ok, err := k.encode(metric, preFlush, full)
 		if err != nil {
 			return err
 		}
+		if !ok && k.format != "metricdata" && !full {
+			notOk++
+		}
 
 		k.MessageBytes.Value(int64(len(data)))
 
@@ -190,3 +230,27 @@ func (k *KafkaMdm) Flush(metrics []*schema.MetricData) error {
 	k.FlushDuration.Value(time.Since(preFlush))
 	return nil
 }
+
+// FlushRaw sends each payload as a message to the first partition
+func (k *KafkaMdm) FlushRaw(payloads [][]byte) error {
+	if len(payloads) == 0 {
+		return nil
+	}
+	msgs := make([]*sarama.ProducerMessage, len(payloads))
+	for i, data := range payloads {
+		k.MessageBytes.Value(int64(len(data)))
+		msgs[i] = &sarama.ProducerMessage{
+			Partition: 0,
+			Topic:     k.topic,
+			Value:     sarama.ByteEncoder(data),
+		}
+	}
+	prePub := time.Now()
+	if err := k.client.SendMessages(msgs); err != nil {
+		k.PublishErrors.Inc(1)
+		return err
+	}
+	k.PublishedMessages.Inc(int64(len(msgs)))
+	k.PublishDuration.Value(time.Since(prePub))
+	return nil
+}
@@ -0,0 +1,106 @@
+package kafkamdm
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/grafana/metrictank/schema"
+	"github.com/grafana/metrictank/schema/msg"
+	"github.com/raintank/fakemetrics/out/kafkamdm/keycache"
+)
+
+func TestEncodeFull(t *testing.T) {
+	k := &KafkaMdm{
+		format:   "metricpoint",
+		keyCache: keycache.NewKeyCache(20*time.Minute, 10*time.Minute),
+	}
+	now := time.Now()
+	md := &schema.MetricData{Id: "1.0123456789abcdef0123456789abcdef", OrgId: 1, Name: "a.b", Interval: 10, Time: 1500000000, Value: 1}
+
+	// the first point of a series is sent in full, the ones after that as MetricPoint
+	data, point, err := k.encode(md, now, false)
+	if err != nil || point {
+		t.Fatalf("expected the first point as MetricData, got point %t and err %v", point, err)
+	}
+	data, point, err = k.encode(md, now, false)
+	if err != nil || !point || data[0] != byte(msg.FormatMetricPoint) {
+		t.Fatalf("expected the second point as MetricPoint, got point %t, err %v and data %x", point, err, data)
+	}
+
+	// a point with an id that doesn't match its name, like the id-mismatch fault makes, must still reach the wire
+	faulty := *md
+	faulty.Name = "a.b.mismatch"
+	data, point, err = k.encode(&faulty, now, true)
+	if err != nil || point {
+		t.Fatalf("expected the faulty point as MetricData, got point %t and err %v", point, err)
+	}
+	var got schema.MetricData
+	if _, err := got.UnmarshalMsg(data); err != nil {
+		t.Fatal(err)
+	}
+	if got.Name != "a.b.mismatch" || got.Id != md.Id {
+		t.Fatalf("expected the faulty name with the original id, got %v with id %s", got, got.Id)
+	}
+}
+
+func TestEncodeFormats(t *testing.T) {
+	const id = "0123456789abcdef0123456789abcdef"
+	cases := []struct {
+		format string
+		org    int
+		exp    msg.Format // of the second point of a series. 0 for MetricData
+	}{
+		{"metricdata", 1, 0},
+		{"metricpoint", 1, msg.FormatMetricPoint},
+		{"metricpoint", 2, msg.FormatMetricPoint},
+		{"metricpoint-without-org", 1, msg.FormatMetricPointWithoutOrg},
+		{"auto", 1, msg.FormatMetricPointWithoutOrg},
+		{"auto", 2, msg.FormatMetricPoint},
+	}
+	for _, c := range cases {
+		k := &KafkaMdm{format: c.format}
+		if c.format != "metricdata" {
+			k.keyCache = keycache.NewKeyCache(20*time.Minute, 10*time.Minute)
+		}
+		md := &schema.MetricData{Id: strconv.Itoa(c.org) + "." + id, OrgId: c.org, Name: "a.b", Interval: 10, Time: 1500000000, Value: 1}
+		now := time.Now()
+		if _, point, err := k.encode(md, now, false); err != nil || point {
+			t.Fatalf("format %s, org %d: expected the first point as MetricData, got point %t and err %v", c.format, c.org, point, err)
+		}
+		data, point, err := k.encode(md, now, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c.exp == 0 {
+			if point {
+				t.Errorf("format %s, org %d: expected MetricData, got a MetricPoint", c.format, c.org)
+			}
+			continue
+		}
+		if !point || data[0] != byte(c.exp) {
+			t.Errorf("format %s, org %d: expected message format %d, got point %t and data %x", c.format, c.org, c.exp, point, data)
+		}
+	}
+}
+
+func TestCheckFormat(t *testing.T) {
+	cases := []struct {
+		format string
+		orgs   int
+		expErr bool
+	}{
+		{"metricdata", 10, false},
+		{"metricpoint", 10, false},
+		{"auto", 10, false},
+		{"metricpoint-without-org", 1, false},
+		{"metricpoint-without-org", 2, true},
+		{"", 1, true},
+		{"msgp", 1, true},
+	}
+	for _, c := range cases {
+		if err := CheckFormat(c.format, c.orgs); c.expErr != (err != nil) {
+			t.Errorf("format %q with %d orgs: expected error %t, got %v", c.format, c.orgs, c.expErr, err)
+		}
+	}
+}
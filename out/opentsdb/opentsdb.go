@@ -0,0 +1,311 @@
+package opentsdb
+
+import (
+	"bytes"
+	"encoding/json"
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/grafana/metrictank/schema"
+	"github.com/jpillora/backoff"
+	"github.com/raintank/fakemetrics/out"
+	"github.com/raintank/met"
+	"github.com/raintank/worldping-api/pkg/log"
+)
+
+type Msg struct {
+	data []byte
+	num  int // metrics contained within
+}
+
+// point is the json representation of a datapoint for /api/put
+type point struct {
+	Metric    string            `json:"metric"`
+	Timestamp int64             `json:"timestamp"`
+	Value     float64           `json:"value"`
+	Tags      map[string]string `json:"tags"`
+}
+
+// OpenTSDB sends metrics to OpenTSDB, either as put lines over the telnet-style tcp protocol,
+// or as json arrays to the http /api/put endpoint.
+// note that OpenTSDB requires at least 1 tag per datapoint.
+// json can't encode NaN or infinite values, so over http, such points are skipped and counted.
+type OpenTSDB struct {
+	sync.Mutex
+	out.OutStats
+
+	addr   string // for tcp
+	conn   net.Conn
+	closed bool
+
+	url       string // for http
+	batchSize int    // max amount of points per http request
+	client    *http.Client
+	queue     chan Msg
+	closer    *out.Closer
+
+	orgTag string // tag to store the org id in. none if empty
+
+	nonFinite met.Count // points not sent over http, because json can't encode their NaN or infinite value
+}
+
+// New creates an OpenTSDB output. addr is either an http(s) url such as http://localhost:4242/api/put
+// or a tcp address such as localhost:4242
+// if orgTag is set, the org id of each metric is added as a tag with that name.
+func New(addr, orgTag string, batchSize int, stats met.Backend) (*OpenTSDB, error) {
+	o := &OpenTSDB{
+		OutStats:  out.NewStats(stats, "opentsdb"),
+		batchSize: batchSize,
+		orgTag:    orgTag,
+		nonFinite: stats.NewCount("metricpublisher.out.opentsdb.non_finite_skipped"),
+	}
+	if strings.HasPrefix(addr, "http://") || strings.HasPrefix(addr, "https://") {
+		o.url = addr
+		o.client = &http.Client{
+			Timeout: 10 * time.Second,
+		}
+		o.queue = make(chan Msg, 100)
+		o.closer = out.NewCloser()
+		go o.run()
+		return o, nil
+	}
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	o.addr = addr
+	o.conn = conn
+	return o, nil
+}
+
+func (o *OpenTSDB) Close() error {
+	if o.url != "" {
+		// wait for everything that was queued to be published
+		return o.closer.Close(func() { close(o.queue) })
+	}
+	o.Lock()
+	defer o.Unlock()
+	if o.closed {
+		return nil
+	}
+	o.closed = true
+	if o.conn == nil {
+		return nil
+	}
+	return o.conn.Close()
+}
+
+func (o *OpenTSDB) Flush(metrics []*schema.MetricData) error {
+	if len(metrics) == 0 {
+		o.FlushDuration.Value(0)
+		return nil
+	}
+	preFlush := time.Now()
+	if o.url == "" {
+		err := o.flushTCP(metrics)
+		o.FlushDuration.Value(time.Since(preFlush))
+		return err
+	}
+
+	var firstErr error
+	for len(metrics) > 0 {
+		n := o.batchSize
+		if n > len(metrics) {
+			n = len(metrics)
+		}
+		points := make([]point, 0, n)
+		for _, m := range metrics[:n] {
+			if math.IsNaN(m.Value) || math.IsInf(m.Value, 0) {
+				o.nonFinite.Inc(1)
+				continue
+			}
+			points = append(points, point{
+				Metric:    sanitize(m.Name),
+				Timestamp: m.Time,
+				Value:     m.Value,
+				Tags:      o.tags(m),
+			})
+		}
+		metrics = metrics[n:]
+		if len(points) == 0 {
+			continue
+		}
+		data, err := json.Marshal(points)
+		if err != nil {
+			// don't let one bad batch hold up the others
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		err = o.closer.Queue(func() {
+			o.PublishQueued.Inc(int64(len(points)))
+			o.queue <- Msg{data, len(points)}
+		})
+		if err != nil {
+			return err
+		}
+	}
+	o.FlushDuration.Value(time.Since(preFlush))
+	return firstErr
+}
+
+// flushTCP writes put lines to the connection.
+// if the connection broke, we try to reconnect on the next flush
+func (o *OpenTSDB) flushTCP(metrics []*schema.MetricData) error {
+	var b []byte
+	for _, m := range metrics {
+		b = append(b, "put "...)
+		b = append(b, sanitize(m.Name)...)
+		b = append(b, ' ')
+		b = strconv.AppendInt(b, m.Time, 10)
+		b = append(b, ' ')
+		b = strconv.AppendFloat(b, m.Value, 'f', -1, 64)
+		// write the tags in a fixed order, so the same input always gives the same line
+		tags := o.tags(m)
+		keys := make([]string, 0, len(tags))
+		for k := range tags {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			b = append(b, ' ')
+			b = append(b, k...)
+			b = append(b, '=')
+			b = append(b, tags[k]...)
+		}
+		b = append(b, '\n')
+	}
+
+	o.Lock()
+	defer o.Unlock()
+	if o.closed {
+		return out.ErrClosed
+	}
+	if o.conn == nil {
+		conn, err := net.Dial("tcp", o.addr)
+		if err != nil {
+			o.PublishErrors.Inc(1)
+			return err
+		}
+		o.Reconnects.Inc(1)
+		o.conn = conn
+	}
+	prePub := time.Now()
+	_, err := o.conn.Write(b)
+	if err != nil {
+		o.PublishErrors.Inc(1)
+		o.conn.Close()
+		o.conn = nil
+		return err
+	}
+	o.MessageBytes.Value(int64(len(b)))
+	o.MessageMetrics.Value(int64(len(metrics)))
+	o.PublishedMetrics.Inc(int64(len(metrics)))
+	o.PublishedMessages.Inc(1)
+	o.PublishDuration.Value(time.Since(prePub))
+	return nil
+}
+
+// tags converts the tags of the metric, and the org tag if enabled, into OpenTSDB tags
+func (o *OpenTSDB) tags(m *schema.MetricData) map[string]string {
+	tags := make(map[string]string, len(m.Tags)+1)
+	for _, tag := range m.Tags {
+		parts := strings.SplitN(tag, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			continue
+		}
+		tags[sanitize(parts[0])] = sanitize(parts[1])
+	}
+	if o.orgTag != "" {
+		tags[o.orgTag] = strconv.Itoa(m.OrgId)
+	}
+	return tags
+}
+
+// sanitize replaces all characters that OpenTSDB does not allow in metric names and tags with underscores
+func sanitize(s string) string {
+	b := []byte(s)
+	for i, c := range b {
+		valid := (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') || c == '-' || c == '_' || c == '.' || c == '/'
+		if !valid {
+			b[i] = '_'
+		}
+	}
+	return string(b)
+}
+
+func (o *OpenTSDB) run() {
+	for m := range o.queue {
+		o.PublishQueued.Dec(int64(m.num))
+		prePub := time.Now()
+		o.publish(m)
+		o.PublishDuration.Value(time.Since(prePub))
+	}
+	o.closer.Done()
+}
+
+func (o *OpenTSDB) publish(m Msg) {
+	b := &backoff.Backoff{
+		Min:    100 * time.Millisecond,
+		Max:    time.Minute,
+		Factor: 1.5,
+		Jitter: true,
+	}
+
+	for {
+		if o.closer.Aborted() {
+			o.closer.Drop(m.num)
+			break
+		}
+		o.MessageBytes.Value(int64(len(m.data)))
+		o.MessageMetrics.Value(int64(m.num))
+		pre := time.Now()
+		req, err := http.NewRequest("POST", o.url, bytes.NewBuffer(m.data))
+		if err != nil {
+			panic(err)
+		}
+		req.Header.Add("Content-Type", "application/json")
+		resp, err := o.client.Do(req)
+		diff := time.Since(pre)
+
+		if err == nil && resp.StatusCode >= 200 && resp.StatusCode < 300 {
+			log.Debug("opentsdb sent %d metrics in %s -msg size %d", m.num, diff, len(m.data))
+			b.Reset()
+			resp.Body.Close()
+			o.PublishedMetrics.Inc(int64(m.num))
+			o.PublishedMessages.Inc(1)
+			break
+		}
+
+		o.PublishErrors.Inc(1)
+
+		// client errors won't get better by retrying, except for rate limiting
+		if err == nil && resp.StatusCode >= 400 && resp.StatusCode < 500 && resp.StatusCode != http.StatusTooManyRequests {
+			buf := make([]byte, 300)
+			n, _ := resp.Body.Read(buf)
+			log.Error(0, "opentsdb failed to submit data: http %d - %s: %s dropping %d metrics", resp.StatusCode, resp.Status, buf[:n], m.num)
+			resp.Body.Close()
+			break
+		}
+
+		dur := b.Duration()
+		if err != nil {
+			log.Warn("opentsdb failed to submit data: %s will try again in %s (this attempt took %s)", err, dur, diff)
+		} else {
+			buf := make([]byte, 300)
+			n, _ := resp.Body.Read(buf)
+			log.Warn("opentsdb failed to submit data: http %d - %s: %s will try again in %s (this attempt took %s)", resp.StatusCode, resp.Status, buf[:n], dur, diff)
+			resp.Body.Close()
+		}
+
+		o.closer.Sleep(dur)
+	}
+}
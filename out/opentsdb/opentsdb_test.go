@@ -0,0 +1,154 @@
+package opentsdb
+
+import (
+	"bufio"
+	"encoding/json"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/grafana/metrictank/schema"
+	"github.com/raintank/fakemetrics/promstats"
+)
+
+// count is a met.Count we can read back
+type count struct {
+	val int64
+}
+
+func (c *count) Inc(val int64) { c.val += val }
+
+func TestFlushHTTPSkipsNonFinite(t *testing.T) {
+	var lock sync.Mutex
+	var got []point
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var points []point
+		if err := json.NewDecoder(r.Body).Decode(&points); err != nil {
+			t.Errorf("can't decode request: %s", err)
+		}
+		lock.Lock()
+		got = append(got, points...)
+		lock.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	o, err := New(srv.URL, "", 2, promstats.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	skipped := &count{}
+	o.nonFinite = skipped
+	var metrics []*schema.MetricData
+	for _, v := range []float64{math.NaN(), 1, math.Inf(1), math.Inf(-1), 2, math.MaxFloat32 * 10} {
+		metrics = append(metrics, &schema.MetricData{Name: "a.b", Time: 1500000000, Value: v, Tags: []string{"a=b"}})
+	}
+	if err := o.Flush(metrics); err != nil {
+		t.Fatal(err)
+	}
+	if err := o.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the batch with only infinite values is skipped, the ones after it are still sent
+	if len(got) != 3 || got[0].Value != 1 || got[1].Value != 2 || got[2].Value != math.MaxFloat32*10 {
+		t.Fatalf("expected the 3 finite points to be sent, got %v", got)
+	}
+	if skipped.val != 3 {
+		t.Fatalf("expected 3 skipped points, got %d", skipped.val)
+	}
+}
+
+func TestFlushTCP(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	lines := make(chan string, 10)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		scanner := bufio.NewScanner(conn)
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+		close(lines)
+	}()
+
+	o, err := New(l.Addr().String(), "org", 0, promstats.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	metrics := []*schema.MetricData{
+		{Name: "a.b", OrgId: 1, Time: 1500000000, Value: 1.5, Tags: []string{"dc=us-east"}},
+		{Name: "a b;c", OrgId: 2, Time: 1500000001, Value: -2, Tags: []string{"k y=v=1", "empty=", "invalid", "=v", "a=b"}},
+	}
+	if err := o.Flush(metrics); err != nil {
+		t.Fatal(err)
+	}
+	if err := o.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// tags are written sorted by key
+	exp := []string{
+		"put a.b 1500000000 1.5 dc=us-east org=1",
+		"put a_b_c 1500000001 -2 a=b k_y=v_1 org=2",
+	}
+	var got []string
+	for line := range lines {
+		got = append(got, line)
+	}
+	if !reflect.DeepEqual(got, exp) {
+		t.Fatalf("expected put lines %q, got %q", exp, got)
+	}
+}
+
+func TestFlushHTTPEncoding(t *testing.T) {
+	var lock sync.Mutex
+	var got []point
+	var contentType string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var points []point
+		if err := json.NewDecoder(r.Body).Decode(&points); err != nil {
+			t.Errorf("can't decode request: %s", err)
+		}
+		lock.Lock()
+		got = append(got, points...)
+		contentType = r.Header.Get("Content-Type")
+		lock.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	o, err := New(srv.URL, "org", 10, promstats.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	metrics := []*schema.MetricData{
+		{Name: "a.b", OrgId: 1, Time: 1500000000, Value: 1.5, Tags: []string{"dc=us-east"}},
+		{Name: "a b;c\"", OrgId: 2, Time: 1500000001, Value: -2, Tags: []string{"k y=v=1", "empty=", "invalid"}},
+	}
+	if err := o.Flush(metrics); err != nil {
+		t.Fatal(err)
+	}
+	if err := o.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	exp := []point{
+		{Metric: "a.b", Timestamp: 1500000000, Value: 1.5, Tags: map[string]string{"dc": "us-east", "org": "1"}},
+		{Metric: "a_b_c_", Timestamp: 1500000001, Value: -2, Tags: map[string]string{"k_y": "v_1", "org": "2"}},
+	}
+	if !reflect.DeepEqual(got, exp) || contentType != "application/json" {
+		t.Fatalf("expected points %v as application/json, got %v as %q", exp, got, contentType)
+	}
+}
@@ -2,6 +2,7 @@ package out
 
 import (
 	"fmt"
+	"math"
 
 	"github.com/grafana/metrictank/schema"
 	"github.com/raintank/met"
@@ -14,6 +15,48 @@ type Out interface {
 	Flush(metrics []*schema.MetricData) error
 }
 
+// RawOut is an Out that can also send raw payloads as they are, e.g. to send malformed messages
+type RawOut interface {
+	Out
+	FlushRaw(payloads [][]byte) error
+}
+
+// FullOut is an Out that sends series it has sent before in a compact format, which only has
+// their id, timestamp and value (such as MetricPoint), but that can also send metrics as full MetricData
+type FullOut interface {
+	Out
+	FlushFull(metrics []*schema.MetricData) error
+}
+
+// FlushFull flushes the metrics to the output, as full MetricData if it supports that
+func FlushFull(o Out, metrics []*schema.MetricData) error {
+	if fo, ok := o.(FullOut); ok {
+		return fo.FlushFull(metrics)
+	}
+	return o.Flush(metrics)
+}
+
+// SkipNonFinite returns the metrics without the ones with a NaN or infinite value, for outputs
+// whose protocol can't represent those, and counts the skipped ones in skipped.
+// the metrics are returned as is, if they're all finite.
+func SkipNonFinite(metrics []*schema.MetricData, skipped met.Count) []*schema.MetricData {
+	for i, m := range metrics {
+		if !math.IsNaN(m.Value) && !math.IsInf(m.Value, 0) {
+			continue
+		}
+		finite := append([]*schema.MetricData(nil), metrics[:i]...)
+		for _, m := range metrics[i:] {
+			if math.IsNaN(m.Value) || math.IsInf(m.Value, 0) {
+				skipped.Inc(1)
+				continue
+			}
+			finite = append(finite, m)
+		}
+		return finite
+	}
+	return metrics
+}
+
 // OutStats tracks metrics related to an Output
 type OutStats struct {
 	FlushDuration     met.Timer // duration of Flush()
@@ -24,6 +67,7 @@ type OutStats struct {
 	PublishedMessages met.Count // number of messages written to underlying storage
 	MessageBytes      met.Meter // number of bytes per message
 	MessageMetrics    met.Meter // number of metrics per message
+	Reconnects        met.Count // not every output uses this
 }
 
 // NewStats creates a new OutStats
@@ -40,5 +84,7 @@ func NewStats(stats met.Backend, output string) OutStats {
 
 		MessageBytes:   stats.NewMeter(fmt.Sprintf("metricpublisher.out.%s.message_bytes", output), 0),
 		MessageMetrics: stats.NewMeter(fmt.Sprintf("metricpublisher.out.%s.message_metrics", output), 0),
+
+		Reconnects: stats.NewCount(fmt.Sprintf("metricpublisher.out.%s.reconnects", output)),
 	}
 }
@@ -0,0 +1,249 @@
+package promrw
+
+import (
+	"bytes"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/grafana/metrictank/schema"
+	"github.com/jpillora/backoff"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/raintank/fakemetrics/out"
+	"github.com/raintank/met"
+	"github.com/raintank/worldping-api/pkg/log"
+)
+
+type Msg struct {
+	data []byte
+	org  int
+	num  int // metrics contained within
+}
+
+// PromRW is an output that sends snappy compressed protobuf WriteRequests
+// to a Prometheus remote write endpoint.
+// each request only contains series of a single org, which is passed via the X-Scope-OrgID header
+type PromRW struct {
+	out.OutStats
+
+	url       string
+	batchSize int // max amount of series per WriteRequest
+	client    *http.Client
+
+	bufSize int // amount of messages we can buffer up before providing backpressure.
+	timeout time.Duration
+
+	queue  chan Msg
+	closer *out.Closer
+}
+
+func New(url string, batchSize int, stats met.Backend) (*PromRW, error) {
+
+	bufSize := 100
+	timeout := 10 * time.Second
+
+	p := &PromRW{
+		OutStats: out.NewStats(stats, "promrw"),
+
+		url:       url,
+		batchSize: batchSize,
+		client: &http.Client{
+			Timeout: timeout,
+		},
+
+		bufSize: bufSize,
+		timeout: timeout,
+
+		queue:  make(chan Msg, bufSize),
+		closer: out.NewCloser(),
+	}
+
+	go p.run()
+	return p, nil
+}
+
+func (p *PromRW) Close() error {
+	// wait for everything that was queued to be published
+	return p.closer.Close(func() { close(p.queue) })
+}
+
+func (p *PromRW) Flush(metrics []*schema.MetricData) error {
+	if len(metrics) == 0 {
+		p.FlushDuration.Value(0)
+		return nil
+	}
+	preFlush := time.Now()
+
+	byOrg := make(map[int][]*schema.MetricData)
+	var orgs []int
+	for _, m := range metrics {
+		if _, ok := byOrg[m.OrgId]; !ok {
+			orgs = append(orgs, m.OrgId)
+		}
+		byOrg[m.OrgId] = append(byOrg[m.OrgId], m)
+	}
+
+	for _, org := range orgs {
+		orgMetrics := byOrg[org]
+		for len(orgMetrics) > 0 {
+			n := p.batchSize
+			if n > len(orgMetrics) {
+				n = len(orgMetrics)
+			}
+			data, err := Encode(orgMetrics[:n])
+			if err != nil {
+				return err
+			}
+			err = p.closer.Queue(func() {
+				p.PublishQueued.Inc(int64(n))
+				p.queue <- Msg{data, org, n}
+			})
+			if err != nil {
+				return err
+			}
+			orgMetrics = orgMetrics[n:]
+		}
+	}
+	p.FlushDuration.Value(time.Since(preFlush))
+	return nil
+}
+
+// Encode converts the metrics into a snappy compressed protobuf WriteRequest
+func Encode(metrics []*schema.MetricData) ([]byte, error) {
+	req := prompb.WriteRequest{
+		Timeseries: make([]prompb.TimeSeries, len(metrics)),
+	}
+	for i, m := range metrics {
+		req.Timeseries[i] = prompb.TimeSeries{
+			Labels: Labels(m),
+			Samples: []prompb.Sample{
+				{
+					Value:     m.Value,
+					Timestamp: m.Time * 1000,
+				},
+			},
+		}
+	}
+	data, err := req.Marshal()
+	if err != nil {
+		return nil, err
+	}
+	return snappy.Encode(nil, data), nil
+}
+
+// Labels converts the name and tags of the metric into prometheus labels, sorted by name as
+// remote write requires. characters that are not valid in prometheus label names are replaced
+// with underscores. if that makes several tags map to the same label, the first one is used.
+func Labels(m *schema.MetricData) []prompb.Label {
+	labels := make([]prompb.Label, 0, len(m.Tags)+1)
+	labels = append(labels, prompb.Label{
+		Name:  "__name__",
+		Value: sanitize(m.Name, true),
+	})
+	for _, tag := range m.Tags {
+		parts := strings.SplitN(tag, "=", 2)
+		if len(parts) != 2 || parts[0] == "name" {
+			continue
+		}
+		labels = append(labels, prompb.Label{
+			Name:  sanitize(parts[0], false),
+			Value: parts[1],
+		})
+	}
+	// a stable sort, so that we keep the first of the duplicates
+	sort.SliceStable(labels, func(i, j int) bool { return labels[i].Name < labels[j].Name })
+	deduped := labels[:1]
+	for _, l := range labels[1:] {
+		if l.Name != deduped[len(deduped)-1].Name {
+			deduped = append(deduped, l)
+		}
+	}
+	return deduped
+}
+
+// sanitize replaces all characters that are not valid in a metric name (if allowColon)
+// or label name with underscores
+func sanitize(s string, allowColon bool) string {
+	b := []byte(s)
+	for i, c := range b {
+		valid := c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (allowColon && c == ':') || (i > 0 && c >= '0' && c <= '9')
+		if !valid {
+			b[i] = '_'
+		}
+	}
+	return string(b)
+}
+
+func (p *PromRW) run() {
+	for m := range p.queue {
+		p.PublishQueued.Dec(int64(m.num))
+		prePub := time.Now()
+		p.publish(m)
+		p.PublishDuration.Value(time.Since(prePub))
+	}
+	p.closer.Done()
+}
+
+func (p *PromRW) publish(m Msg) {
+	b := &backoff.Backoff{
+		Min:    100 * time.Millisecond,
+		Max:    time.Minute,
+		Factor: 1.5,
+		Jitter: true,
+	}
+
+	for {
+		if p.closer.Aborted() {
+			p.closer.Drop(m.num)
+			break
+		}
+		p.MessageBytes.Value(int64(len(m.data)))
+		p.MessageMetrics.Value(int64(m.num))
+		pre := time.Now()
+		req, err := http.NewRequest("POST", p.url, bytes.NewBuffer(m.data))
+		if err != nil {
+			panic(err)
+		}
+		req.Header.Add("Content-Encoding", "snappy")
+		req.Header.Add("Content-Type", "application/x-protobuf")
+		req.Header.Add("X-Prometheus-Remote-Write-Version", "0.1.0")
+		req.Header.Add("X-Scope-OrgID", strconv.Itoa(m.org))
+		resp, err := p.client.Do(req)
+		diff := time.Since(pre)
+
+		if err == nil && resp.StatusCode >= 200 && resp.StatusCode < 300 {
+			log.Debug("promrw sent %d metrics in %s -msg size %d", m.num, diff, len(m.data))
+			b.Reset()
+			resp.Body.Close()
+			p.PublishedMetrics.Inc(int64(m.num))
+			p.PublishedMessages.Inc(1)
+			break
+		}
+
+		p.PublishErrors.Inc(1)
+
+		// client errors won't get better by retrying, except for rate limiting
+		if err == nil && resp.StatusCode >= 400 && resp.StatusCode < 500 && resp.StatusCode != http.StatusTooManyRequests {
+			buf := make([]byte, 300)
+			n, _ := resp.Body.Read(buf)
+			log.Error(0, "promrw failed to submit data: http %d - %s: %s dropping %d metrics", resp.StatusCode, resp.Status, buf[:n], m.num)
+			resp.Body.Close()
+			break
+		}
+
+		dur := b.Duration()
+		if err != nil {
+			log.Warn("promrw failed to submit data: %s will try again in %s (this attempt took %s)", err, dur, diff)
+		} else {
+			buf := make([]byte, 300)
+			n, _ := resp.Body.Read(buf)
+			log.Warn("promrw failed to submit data: http %d - %s: %s will try again in %s (this attempt took %s)", resp.StatusCode, resp.Status, buf[:n], dur, diff)
+			resp.Body.Close()
+		}
+
+		p.closer.Sleep(dur)
+	}
+}
@@ -0,0 +1,58 @@
+package promrw
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/grafana/metrictank/schema"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/raintank/fakemetrics/out"
+	"github.com/raintank/fakemetrics/promstats"
+)
+
+func TestLabels(t *testing.T) {
+	m := &schema.MetricData{
+		Name: "some.id.of.a.metric.1",
+		Tags: []string{"region=west", "name=ignored", "dc-name=us.east=1", "invalid", "dc.name=other", "__name__=sneaky"},
+	}
+	exp := []prompb.Label{
+		{Name: "__name__", Value: "some_id_of_a_metric_1"},
+		{Name: "dc_name", Value: "us.east=1"},
+		{Name: "region", Value: "west"},
+	}
+	got := Labels(m)
+	if !reflect.DeepEqual(got, exp) {
+		t.Fatalf("expected labels %v, got %v", exp, got)
+	}
+}
+
+func TestCloseGivesUp(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+	defer func(timeout time.Duration) { out.CloseTimeout = timeout }(out.CloseTimeout)
+	out.CloseTimeout = 200 * time.Millisecond
+
+	p, err := New(srv.URL, 10, promstats.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	metrics := []*schema.MetricData{{OrgId: 1, Name: "a.b", Time: 1500000000, Value: 1}}
+	if err := p.Flush(metrics); err != nil {
+		t.Fatal(err)
+	}
+	pre := time.Now()
+	if err := p.Close(); err == nil {
+		t.Fatal("expected an error for the metrics that could not be published")
+	}
+	if took := time.Since(pre); took > time.Second {
+		t.Fatalf("expected close to give up after 200ms, took %s", took)
+	}
+	if err := p.Flush(metrics); err != out.ErrClosed {
+		t.Fatalf("expected flush after close to fail with %q, got %v", out.ErrClosed, err)
+	}
+}
@@ -0,0 +1,138 @@
+package statsd
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/grafana/metrictank/schema"
+	"github.com/raintank/fakemetrics/out"
+	"github.com/raintank/met"
+)
+
+// Statsd sends metrics as statsd lines over udp, batching as many lines per packet
+// as fit in packetSize bytes.
+// the statsd metric type is derived from the mtype: count, counter and rate become
+// counters, timestamp and timer become timers, and everything else is sent as gauge.
+// characters that would break the line format are replaced with underscores.
+// statsd has no NaN or infinite values, so such points are skipped and counted.
+type Statsd struct {
+	sync.Mutex
+	out.OutStats
+	conn       net.Conn
+	datadog    bool // whether to add tags in the datadog format
+	packetSize int
+	nonFinite  met.Count // points not sent, because statsd can't represent their NaN or infinite value
+}
+
+// New creates a statsd output. flavor is standard or datadog.
+// the standard flavor has no support for tags, so they are not sent.
+func New(addr, flavor string, packetSize int, stats met.Backend) (*Statsd, error) {
+	if flavor != "standard" && flavor != "datadog" {
+		return nil, fmt.Errorf("invalid statsd type %q. must be standard or datadog", flavor)
+	}
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &Statsd{
+		OutStats:   out.NewStats(stats, "statsd"),
+		conn:       conn,
+		datadog:    flavor == "datadog",
+		packetSize: packetSize,
+		nonFinite:  stats.NewCount("metricpublisher.out.statsd.non_finite_skipped"),
+	}, nil
+}
+
+func (s *Statsd) Close() error {
+	return s.conn.Close()
+}
+
+func (s *Statsd) Flush(metrics []*schema.MetricData) error {
+	if len(metrics) == 0 {
+		s.FlushDuration.Value(0)
+		return nil
+	}
+	preFlush := time.Now()
+	metrics = out.SkipNonFinite(metrics, s.nonFinite)
+	s.Lock()
+	defer s.Unlock()
+
+	var firstErr error
+	var packet, line []byte
+	var num int
+	send := func() {
+		if num == 0 {
+			return
+		}
+		prePub := time.Now()
+		_, err := s.conn.Write(packet)
+		if err != nil {
+			s.PublishErrors.Inc(1)
+			if firstErr == nil {
+				firstErr = err
+			}
+		} else {
+			s.MessageBytes.Value(int64(len(packet)))
+			s.MessageMetrics.Value(int64(num))
+			s.PublishedMetrics.Inc(int64(num))
+			s.PublishedMessages.Inc(1)
+			s.PublishDuration.Value(time.Since(prePub))
+		}
+		packet, num = packet[:0], 0
+	}
+	for _, m := range metrics {
+		line = s.appendLine(line[:0], m)
+		// lines within a packet are separated by newlines
+		if num > 0 && len(packet)+1+len(line) > s.packetSize {
+			send()
+		}
+		if num > 0 {
+			packet = append(packet, '\n')
+		}
+		packet = append(packet, line...)
+		num++
+	}
+	send()
+	s.FlushDuration.Value(time.Since(preFlush))
+	return firstErr
+}
+
+var (
+	// nameReplacer replaces the characters that separate the name from the value and type, and the lines
+	nameReplacer = strings.NewReplacer(":", "_", "|", "_", "@", "_", "\n", "_")
+	// tagReplacer replaces the characters that separate the tags from each other and the rest of the line
+	tagReplacer = strings.NewReplacer(",", "_", "|", "_", "#", "_", "\n", "_")
+)
+
+// appendLine appends the metric as name:value|type, followed by |#tag:value,... for datadog
+func (s *Statsd) appendLine(b []byte, m *schema.MetricData) []byte {
+	b = append(b, nameReplacer.Replace(m.Name)...)
+	b = append(b, ':')
+	b = strconv.AppendFloat(b, m.Value, 'f', -1, 64)
+	b = append(b, '|')
+	b = append(b, statsdType(m.Mtype)...)
+	if s.datadog && len(m.Tags) > 0 {
+		b = append(b, "|#"...)
+		for i, tag := range m.Tags {
+			if i > 0 {
+				b = append(b, ',')
+			}
+			b = append(b, tagReplacer.Replace(strings.Replace(tag, "=", ":", 1))...)
+		}
+	}
+	return b
+}
+
+func statsdType(mtype string) string {
+	switch mtype {
+	case "count", "counter", "rate":
+		return "c"
+	case "timestamp", "timer":
+		return "ms"
+	}
+	return "g"
+}
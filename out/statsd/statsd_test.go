@@ -0,0 +1,73 @@
+package statsd
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/grafana/metrictank/schema"
+	"github.com/raintank/fakemetrics/promstats"
+)
+
+func TestAppendLine(t *testing.T) {
+	cases := []struct {
+		datadog bool
+		m       schema.MetricData
+		exp     string
+	}{
+		{false, schema.MetricData{Name: "a.b", Value: 1.5, Mtype: "gauge", Tags: []string{"dc=us"}}, "a.b:1.5|g"},
+		{false, schema.MetricData{Name: "a.b", Value: 3, Mtype: "counter"}, "a.b:3|c"},
+		{false, schema.MetricData{Name: "a.b", Value: 3, Mtype: "rate"}, "a.b:3|c"},
+		{false, schema.MetricData{Name: "a.b", Value: 250, Mtype: "timer"}, "a.b:250|ms"},
+		{false, schema.MetricData{Name: "a.b", Value: -1, Mtype: ""}, "a.b:-1|g"},
+		{false, schema.MetricData{Name: "a:b|c@d\ne", Value: 1, Mtype: "gauge"}, "a_b_c_d_e:1|g"},
+		{true, schema.MetricData{Name: "a.b", Value: 1, Mtype: "gauge"}, "a.b:1|g"},
+		{true, schema.MetricData{Name: "a.b", Value: 1, Mtype: "count", Tags: []string{"dc=us", "url=http://x=y"}}, "a.b:1|c|#dc:us,url:http://x=y"},
+		{true, schema.MetricData{Name: "a.b", Value: 1, Mtype: "gauge", Tags: []string{"k=a,b|c#d\ne"}}, "a.b:1|g|#k:a_b_c_d_e"},
+	}
+	for _, c := range cases {
+		s := &Statsd{datadog: c.datadog}
+		if got := string(s.appendLine(nil, &c.m)); got != c.exp {
+			t.Errorf("datadog %t, metric %v: expected %q, got %q", c.datadog, c.m, c.exp, got)
+		}
+	}
+}
+
+func TestFlushPackets(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	s, err := New(conn.LocalAddr().String(), "standard", 100, promstats.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	// lines of 14 bytes: 6 of them and their separators fit in 100 bytes
+	var metrics []*schema.MetricData
+	for n := 0; n < 10; n++ {
+		metrics = append(metrics, &schema.MetricData{Name: "some.name", Value: 10 + float64(n), Mtype: "gauge"})
+	}
+	if err := s.Flush(metrics); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 1024)
+	var lines []string
+	for len(lines) < 10 {
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("expected 10 lines, got %d before failing to read: %s", len(lines), err)
+		}
+		if n > 100 {
+			t.Fatalf("expected packets of at most 100 bytes, got %d", n)
+		}
+		lines = append(lines, strings.Split(string(buf[:n]), "\n")...)
+	}
+	if len(lines) != 10 || lines[0] != "some.name:10|g" || lines[9] != "some.name:19|g" {
+		t.Fatalf("expected 10 lines, got %q", lines)
+	}
+}
@@ -0,0 +1,226 @@
+// Package promstats provides a met.Backend that exposes the stats in the Prometheus text exposition format.
+package promstats
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/raintank/met"
+)
+
+// buckets are the upper bounds, in seconds, of the histogram buckets for timers
+var buckets = []float64{0.0001, 0.00025, 0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+type kind int
+
+const (
+	counter kind = iota
+	gauge
+	summary   // for meters. we only track the sum and count
+	histogram // for timers
+)
+
+var kindNames = map[kind]string{
+	counter:   "counter",
+	gauge:     "gauge",
+	summary:   "summary",
+	histogram: "histogram",
+}
+
+// metric is a single series. all of its values are accessed atomically.
+type metric struct {
+	name   string
+	labels string // rendered labels, e.g. {output="carbon"} or empty
+	kind   kind
+
+	value   int64 // for counters and gauges
+	sum     int64 // for summaries in raw units, for histograms in ns
+	count   int64
+	buckets []int64 // for histograms, non-cumulative
+}
+
+func (m *metric) Inc(val int64) {
+	atomic.AddInt64(&m.value, val)
+}
+
+func (m *metric) Dec(val int64) {
+	atomic.AddInt64(&m.value, -val)
+}
+
+// Value sets a gauge, or adds an observation to a summary
+func (m *metric) Value(val int64) {
+	if m.kind == gauge {
+		atomic.StoreInt64(&m.value, val)
+		return
+	}
+	atomic.AddInt64(&m.sum, val)
+	atomic.AddInt64(&m.count, 1)
+}
+
+type timer struct {
+	*metric
+}
+
+func (t timer) Value(val time.Duration) {
+	atomic.AddInt64(&t.sum, int64(val))
+	atomic.AddInt64(&t.count, 1)
+	i := sort.SearchFloat64s(buckets, val.Seconds())
+	if i < len(buckets) {
+		atomic.AddInt64(&t.buckets[i], 1)
+	}
+}
+
+// Backend is a met.Backend that serves all stats on http in the Prometheus text exposition format.
+// stats keys are converted into metric names by prefixing them with "fakemetrics_" and replacing
+// all invalid characters with underscores, except that the stats of the outputs,
+// metricpublisher.out.<output>.<stat>, become fakemetrics_out_<stat>{output="<output>"}
+// and the global stats, metricpublisher.global.<stat>, become fakemetrics_<stat>.
+// stats with the same key share their state.
+type Backend struct {
+	sync.Mutex
+	metrics map[string]*metric // by name and labels
+}
+
+func New() *Backend {
+	return &Backend{
+		metrics: make(map[string]*metric),
+	}
+}
+
+// get returns the metric for the key, and whether it was created by this call
+func (b *Backend) get(key string, k kind) (*metric, bool) {
+	name, labels := convert(key)
+	switch k {
+	case counter:
+		name += "_total"
+	case histogram:
+		name += "_seconds"
+	}
+	b.Lock()
+	defer b.Unlock()
+	m, ok := b.metrics[name+labels]
+	if !ok {
+		m = &metric{
+			name:   name,
+			labels: labels,
+			kind:   k,
+		}
+		if k == histogram {
+			m.buckets = make([]int64, len(buckets))
+		}
+		b.metrics[name+labels] = m
+	}
+	return m, !ok
+}
+
+func (b *Backend) NewCount(key string) met.Count {
+	m, _ := b.get(key, counter)
+	return m
+}
+
+// NewGauge returns the gauge for the key. only a newly created gauge is set to val
+func (b *Backend) NewGauge(key string, val int64) met.Gauge {
+	m, created := b.get(key, gauge)
+	if created {
+		m.Value(val)
+	}
+	return m
+}
+
+func (b *Backend) NewMeter(key string, val int64) met.Meter {
+	m, _ := b.get(key, summary)
+	return m
+}
+
+func (b *Backend) NewTimer(key string, val time.Duration) met.Timer {
+	m, _ := b.get(key, histogram)
+	return timer{m}
+}
+
+// convert converts a stats key into a metric name and labels
+func convert(key string) (string, string) {
+	if strings.HasPrefix(key, "metricpublisher.out.") {
+		parts := strings.SplitN(strings.TrimPrefix(key, "metricpublisher.out."), ".", 2)
+		if len(parts) == 2 {
+			return "fakemetrics_out_" + sanitize(parts[1]), `{output="` + parts[0] + `"}`
+		}
+	}
+	return "fakemetrics_" + sanitize(strings.TrimPrefix(key, "metricpublisher.global.")), ""
+}
+
+// sanitize replaces all characters that are not valid in a metric name with underscores
+func sanitize(s string) string {
+	b := []byte(s)
+	for i, c := range b {
+		valid := (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') || c == '_' || c == ':'
+		if !valid {
+			b[i] = '_'
+		}
+	}
+	return string(b)
+}
+
+// withLabel adds a label to the rendered labels
+func withLabel(labels, name, value string) string {
+	if labels == "" {
+		return "{" + name + `="` + value + `"}`
+	}
+	return labels[:len(labels)-1] + "," + name + `="` + value + `"}`
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// ServeHTTP writes all metrics in the Prometheus text exposition format
+func (b *Backend) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	b.Lock()
+	metrics := make([]*metric, 0, len(b.metrics))
+	for _, m := range b.metrics {
+		metrics = append(metrics, m)
+	}
+	b.Unlock()
+	sort.Slice(metrics, func(i, j int) bool {
+		if metrics[i].name != metrics[j].name {
+			return metrics[i].name < metrics[j].name
+		}
+		return metrics[i].labels < metrics[j].labels
+	})
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	bw := bufio.NewWriter(w)
+	for i, m := range metrics {
+		if i == 0 || metrics[i-1].name != m.name {
+			fmt.Fprintf(bw, "# TYPE %s %s\n", m.name, kindNames[m.kind])
+		}
+		switch m.kind {
+		case counter, gauge:
+			fmt.Fprintf(bw, "%s%s %d\n", m.name, m.labels, atomic.LoadInt64(&m.value))
+		case summary:
+			fmt.Fprintf(bw, "%s_sum%s %d\n", m.name, m.labels, atomic.LoadInt64(&m.sum))
+			fmt.Fprintf(bw, "%s_count%s %d\n", m.name, m.labels, atomic.LoadInt64(&m.count))
+		case histogram:
+			// read the count first, so that the buckets never exceed it
+			count := atomic.LoadInt64(&m.count)
+			var cumulative int64
+			for j, le := range buckets {
+				cumulative += atomic.LoadInt64(&m.buckets[j])
+				if cumulative > count {
+					cumulative = count
+				}
+				fmt.Fprintf(bw, "%s_bucket%s %d\n", m.name, withLabel(m.labels, "le", formatFloat(le)), cumulative)
+			}
+			fmt.Fprintf(bw, "%s_bucket%s %d\n", m.name, withLabel(m.labels, "le", "+Inf"), count)
+			fmt.Fprintf(bw, "%s_sum%s %s\n", m.name, m.labels, formatFloat(time.Duration(atomic.LoadInt64(&m.sum)).Seconds()))
+			fmt.Fprintf(bw, "%s_count%s %d\n", m.name, m.labels, count)
+		}
+	}
+	bw.Flush()
+}
@@ -0,0 +1,48 @@
+package promstats
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServeHTTP(t *testing.T) {
+	b := New()
+	b.NewCount("metricpublisher.out.carbon.published_metrics").Inc(3)
+	// stats with the same key are shared
+	b.NewCount("metricpublisher.out.carbon.published_metrics").Inc(2)
+	b.NewGauge("metricpublisher.out.gnet.publish_queued", 5).Dec(1)
+	// getting a shared gauge again doesn't reset it
+	b.NewGauge("metricpublisher.out.gnet.publish_queued", 0)
+	b.NewMeter("metricpublisher.out.carbon.message_bytes", 0).Value(100)
+	tm := b.NewTimer("metricpublisher.global.flush_duration", 0)
+	tm.Value(2 * time.Millisecond)
+	tm.Value(time.Minute)
+
+	rec := httptest.NewRecorder()
+	b.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body := rec.Body.String()
+
+	exp := []string{
+		"# TYPE fakemetrics_flush_duration_seconds histogram\n",
+		`fakemetrics_flush_duration_seconds_bucket{le="0.001"} 0` + "\n",
+		`fakemetrics_flush_duration_seconds_bucket{le="0.0025"} 1` + "\n",
+		`fakemetrics_flush_duration_seconds_bucket{le="10"} 1` + "\n",
+		`fakemetrics_flush_duration_seconds_bucket{le="+Inf"} 2` + "\n",
+		"fakemetrics_flush_duration_seconds_sum 60.002\n",
+		"fakemetrics_flush_duration_seconds_count 2\n",
+		"# TYPE fakemetrics_out_message_bytes summary\n",
+		`fakemetrics_out_message_bytes_sum{output="carbon"} 100` + "\n",
+		`fakemetrics_out_message_bytes_count{output="carbon"} 1` + "\n",
+		"# TYPE fakemetrics_out_publish_queued gauge\n",
+		`fakemetrics_out_publish_queued{output="gnet"} 4` + "\n",
+		"# TYPE fakemetrics_out_published_metrics_total counter\n",
+		`fakemetrics_out_published_metrics_total{output="carbon"} 5` + "\n",
+	}
+	for _, e := range exp {
+		if !strings.Contains(body, e) {
+			t.Errorf("expected output to contain %q. got:\n%s", e, body)
+		}
+	}
+}